@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yambabmay/yyabws/server/rlmd"
+	"github.com/yambabmay/yyabws/server/rlmu"
+	"go.uber.org/zap"
+)
+
+// upstreamKeyStatus - The state of an upstream key served
+// on the admin endpoint
+type upstreamKeyStatus struct {
+	// Key the index of the key, the secret is not shown
+	Key           int            `json:"key"`
+	Inflight      int            `json:"inflight"`
+	DisabledUntil *time.Time     `json:"disabled_until,omitempty"`
+	Limiter       *rlmu.Snapshot `json:"limiter"`
+}
+
+// writeJSON - Writes a JSON response body
+func writeJSON(resp http.ResponseWriter, status int, body any) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(body)
+}
+
+// upstreamHandler - Serves the state of the upstream keys and
+// of their rate limiters
+func (s *atlasClient) upstreamHandler(resp http.ResponseWriter, req *http.Request) {
+	s.pool.Lock()
+	statuses := make([]upstreamKeyStatus, len(s.pool.keys))
+	for i, key := range s.pool.keys {
+		statuses[i] = upstreamKeyStatus{Key: key.index, Inflight: key.inflight}
+		if key.disabledUntil.After(time.Now()) {
+			until := key.disabledUntil
+			statuses[i].DisabledUntil = &until
+		}
+	}
+	s.pool.Unlock()
+	for i, key := range s.pool.keys {
+		statuses[i].Limiter = key.us.Snapshot()
+	}
+	writeJSON(resp, http.StatusOK, statuses)
+}
+
+// suspensionsHandler - Serves the secrets suspended by the penalty box
+// of this replica
+func (s *atlasClient) suspensionsHandler(resp http.ResponseWriter, req *http.Request) {
+	suspensions := s.ds.Suspensions()
+	if suspensions == nil {
+		suspensions = []rlmd.Suspension{}
+	}
+	writeJSON(resp, http.StatusOK, suspensions)
+}
+
+// adminAuth - Lets through the requests to an admin endpoint that
+// carry the admin token as a bearer token, the others are
+// answered with 401 Unauthorized.
+func (s *atlasClient) adminAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.settings.AdminToken)) != 1 {
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(resp, http.StatusUnauthorized, "unauthorized", "the admin token is missing or invalid")
+			return
+		}
+		handler(resp, req)
+	}
+}
+
+// serveAdmin - Serves the admin endpoints, on an address of their
+// own so that they are not exposed with the proxy.
+func (s *atlasClient) serveAdmin() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/upstream", s.upstreamHandler)
+	mux.HandleFunc("GET /admin/suspensions", s.suspensionsHandler)
+	if s.settings.AdminToken != "" {
+		mux.HandleFunc("POST /admin/secrets/rotate", s.adminAuth(s.rotateHandler))
+	} else {
+		s.logger.Info("not serving the secret rotation endpoint, ADMIN_TOKEN is not set")
+	}
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	s.logger.Info("serving admin endpoints", zap.String("addr", s.settings.AdminAddr))
+	if err := http.ListenAndServe(s.settings.AdminAddr, mux); err != nil {
+		s.logger.Error("serving admin endpoints", zap.Error(err))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// cost - The units a request for take records of an endpoint costs the
+// downstream secret: the cost of the endpoint for every TakeCostStep
+// records, started.
+func (s *atlasClient) cost(req *http.Request, take int) int {
+	return s.settings.cost(req.URL.Path, take)
+}
+
+// cost - The units a request for take records of the endpoint path
+// costs, the endpoints not listed in RouteCosts cost 1 unit per step.
+func (s *Settings) cost(path string, take int) int {
+	units, ok := s.RouteCosts[path]
+	if !ok {
+		units = 1
+	}
+	step := s.TakeCostStep
+	return units * max((take+step-1)/step, 1)
+}
+
+// validateCosts - Checks that an Atlas page of every endpoint costs
+// no more than the downstream limits it is charged to, otherwise its
+// requests for a full page would always be denied.
+func (s *Settings) validateCosts() error {
+	ds := s.dsRlmSettings
+	paths := slices.Sorted(maps.Keys(s.RouteCosts))
+	for path := range ds.EndpointRequestsPerSecond {
+		if !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	// The endpoints not listed, by the empty path
+	paths = append(paths, "")
+	for _, path := range paths {
+		cost := s.cost(path, atlasPageSize)
+		endpoint := path
+		if endpoint == "" {
+			endpoint = "the endpoints not listed"
+		}
+		if cost > ds.RequestsPerSecond {
+			return fmt.Errorf("a page of %s costs %d units, more than DS_REQUESTS_PER_SECOND %d",
+				endpoint, cost, ds.RequestsPerSecond)
+		}
+		if ds.GlobalRequestsPerSecond > 0 && cost > ds.GlobalRequestsPerSecond {
+			return fmt.Errorf("a page of %s costs %d units, more than DS_GLOBAL_REQUESTS_PER_SECOND %d",
+				endpoint, cost, ds.GlobalRequestsPerSecond)
+		}
+		if rps, ok := ds.EndpointRequestsPerSecond[path]; ok && cost > rps {
+			return fmt.Errorf("a page of %s costs %d units, more than its DS_ENDPOINT_REQUESTS_PER_SECOND %d",
+				endpoint, cost, rps)
+		}
+	}
+	return nil
+}
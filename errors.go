@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/yambabmay/yyabws/server/rlmd"
+)
+
+// apiError - A structured error returned to the clients
+type apiError struct {
+	// Code identifies the error, it is stable and meant
+	// to be matched by the clients.
+	Code string `json:"code"`
+	// Message is a human readable description of the error
+	Message string `json:"message"`
+	// Parameter is the query parameter the error refers to, if any
+	Parameter string `json:"parameter,omitempty"`
+}
+
+// errorBody - The body of an error response
+type errorBody struct {
+	Errors []apiError `json:"errors"`
+}
+
+// writeErrors - Writes an error response with a JSON body
+func writeErrors(resp http.ResponseWriter, status int, errs ...apiError) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(errorBody{Errors: errs})
+}
+
+// writeError - Writes an error response with a single error
+func writeError(resp http.ResponseWriter, status int, code, message string) {
+	writeErrors(resp, status, apiError{Code: code, Message: message})
+}
+
+// secretStateError - Returns the error code and message of
+// a request with a secret in a lifecycle state other than active
+func secretStateError(state string) (code, message string) {
+	switch state {
+	case rlmd.StateSuspended:
+		return "secret_disabled", "the secret is disabled"
+	case rlmd.StateRevoked:
+		return "secret_revoked", "the secret is revoked"
+	case rlmd.StateExpired:
+		return "secret_expired", "the secret is expired"
+	case rlmd.StatePending:
+		return "secret_not_yet_valid", "the secret is not valid yet"
+	}
+	return "secret_inactive", "the secret is not active"
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yambabmay/yyabws/server/rlmd"
+	"go.uber.org/zap"
+)
+
+// Conditional request headers relayed to Atlas
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// strongETag - Computes a strong entity tag from a body
+func strongETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return sumETag(sum[:])
+}
+
+// sumETag - Makes a strong entity tag from the SHA-256 sum of a body
+func sumETag(sum []byte) string {
+	return "\"" + base64.RawURLEncoding.EncodeToString(sum[:16]) + "\""
+}
+
+// etagWithSuffix - Appends a suffix to the opaque part of an entity tag,
+// so that the representations produced by the proxy from the same
+// upstream body do not share a strong entity tag.
+func etagWithSuffix(etag, suffix string) string {
+	if suffix == "" || !strings.HasSuffix(etag, "\"") {
+		return etag
+	}
+	return etag[:len(etag)-1] + suffix + "\""
+}
+
+// etagMatches - Returns true if one of the entity tags of an
+// If-None-Match header matches etag, using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	opaque := strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == opaque {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedSince - Returns true if lastModified is not after
+// the If-Modified-Since date.
+func notModifiedSince(ifModifiedSince, lastModified string) bool {
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// notModified - Evaluates the conditional headers of the downstream
+// request against the validators of the response.
+func notModified(req *http.Request, etag, lastModified string) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etag != "" && etagMatches(ifNoneMatch, etag)
+	}
+	if ifModifiedSince := req.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		return lastModified != "" && notModifiedSince(ifModifiedSince, lastModified)
+	}
+	return false
+}
+
+// representationSuffix - The entity tag suffix of the representation
+// streamResponse produces from the upstream response.
+func representationSuffix(accepted map[string]float64, upstream *http.Response) string {
+	switch encoding := upstreamEncoding(upstream); {
+	case compressOnTheFly(accepted, upstream):
+		return "-gzip"
+	case encoding != "" && !accepts(accepted, encoding):
+		return "-identity"
+	}
+	return ""
+}
+
+// bufferedBody - A body partially or completely read in memory
+type bufferedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// hashingBody - A body hashed as it is streamed, so that its ETag
+// is sent in a trailer
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	// suffix the entity tag suffix of the representation
+	suffix string
+	// eof is set once the whole body was read
+	eof bool
+}
+
+func (s *hashingBody) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.hash.Write(p[:n])
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
+
+// etag - returns the strong entity tag of the body, once it was
+// completely read, "" otherwise
+func (s *hashingBody) etag() string {
+	if !s.eof {
+		return ""
+	}
+	return etagWithSuffix(sumETag(s.hash.Sum(nil)), s.suffix)
+}
+
+// bufferedETag - Reads the body of a response, up to the configured
+// limit, and returns its strong ETag, "" if it is larger. The body is
+// replayed to the client.
+func (s *atlasClient) bufferedETag(upstream *http.Response) string {
+	var etag string
+	limit := s.settings.ETagMaxBodySize
+	buf, err := io.ReadAll(io.LimitReader(upstream.Body, limit+1))
+	if err != nil {
+		s.logger.Debug("buffering response", zap.Error(err))
+	}
+	if err == nil && int64(len(buf)) <= limit {
+		etag = strongETag(buf)
+		upstream.ContentLength = int64(len(buf))
+	}
+	// Replay the buffered part of the body
+	upstream.Body = &bufferedBody{
+		Reader: io.MultiReader(bytes.NewReader(buf), upstream.Body),
+		Closer: upstream.Body,
+	}
+	return etag
+}
+
+// validators - Sets the ETag and Last-Modified headers of the response.
+// The upstream ETag is relayed. When there is none, a strong ETag is
+// computed from the body, buffered if it is not larger than the
+// configured limit, so that the ETag is sent in a header. A larger body
+// is streamed with its ETag in a trailer, which most clients ignore,
+// and a request with an If-None-Match header gets it in full since it
+// can not be matched. Returns true if the
+// downstream request conditions are met and the client should get a
+// "304 Not Modified".
+func (s *atlasClient) validators(resp http.ResponseWriter, req *http.Request, upstream *http.Response) bool {
+	accepted := acceptedEncodings(req.Header.Get("Accept-Encoding"))
+	suffix := representationSuffix(accepted, upstream)
+	etag := upstream.Header.Get("ETag")
+	if etag == "" {
+		etag = s.bufferedETag(upstream)
+	}
+	if etag != "" {
+		etag = etagWithSuffix(etag, suffix)
+		resp.Header().Set("ETag", etag)
+	}
+	lastModified := upstream.Header.Get("Last-Modified")
+	if lastModified != "" {
+		resp.Header().Set("Last-Modified", lastModified)
+	}
+	if notModified(req, etag, lastModified) {
+		return true
+	}
+	if etag == "" {
+		// The trailers are sent with a chunked body only
+		upstream.Body = &hashingBody{ReadCloser: upstream.Body, hash: sha256.New(), suffix: suffix}
+		upstream.ContentLength = -1
+		resp.Header().Set("Trailer", "ETag")
+	}
+	return false
+}
+
+// writeNotModified - Answers a conditional request with
+// "304 Not Modified", and lowers its downstream cost from
+// the charged units.
+func (s *atlasClient) writeNotModified(resp http.ResponseWriter, req *http.Request, grant *rlmd.Grant) {
+	if err := s.ds.NotModified(req.Context(), grant); err != nil {
+		s.logger.Warn("refunding not modified response", zap.Error(err))
+	}
+	// The remaining units after the refund
+	if err := s.rateLimitHeaders(resp, grant.Secret); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Add("Vary", "Accept-Encoding")
+	resp.WriteHeader(http.StatusNotModified)
+}
@@ -6,9 +6,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
-	"strconv"
+	"time"
 
 	"github.com/yambabmay/yyabws/server/rlmd"
 	"github.com/yambabmay/yyabws/server/rlmu"
@@ -18,38 +19,117 @@ import (
 const (
 	atlasURL       = "https://atlas.abiosgaming.com/v3"
 	secretHederKey = "Abios-Secret"
+	// The header telling which limit denied a request
+	rateLimitScopeKey = "X-RateLimit-Scope"
+	// The scope of the requests denied by the penalty box
+	scopePenalty = "penalty"
+	// The maximum number of records in an Atlas page
+	atlasPageSize = 50
 )
 
 // atlasClient - Atlas client
 type atlasClient struct {
 	settings *Settings
 	ds       *rlmd.RateLimiter
-	us       *rlmu.RateLimiter
+	pool     *upstreamPool
+	client   *http.Client
+	routes   map[string]*route
 	logger   *zap.Logger
 }
 
-func (s *atlasClient) init() error {
-	bURL, _ := url.Parse(s.settings.URL + "/series")
+// probe - Sends a request to Atlas to learn the rate limiting
+// information of an upstream key. Its slot is given back if the
+// request does not reach Atlas.
+func (s *atlasClient) probe(key *upstreamKey) error {
+	reservation, err := key.us.Reserve(rlmu.Ticket{})
+	if err != nil {
+		return errNoUpstreamSlot
+	}
 	values := url.Values{}
 	values.Set("lifecycle", "live")
 	values.Set("take", fmt.Sprintf("%d", 1))
-	bURL.RawQuery = values.Encode()
-	req, _ := http.NewRequest(http.MethodGet, bURL.String(), nil)
-	req.Header.Add(secretHederKey, s.settings.Secret)
-	cli := &http.Client{}
-	rsp, err := cli.Do(req)
+	ctx, cancel := context.WithTimeout(context.Background(), s.settings.transport.Timeout)
+	defer cancel()
+	rsp, err := s.send(ctx, key, reservation, "/series", values, "", nil)
 	if err != nil {
 		return err
 	}
 	defer rsp.Body.Close()
+	io.Copy(io.Discard, rsp.Body)
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusTooManyRequests:
+		key.us.Update(rsp.Header)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		s.pool.disable(key, rsp.StatusCode)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("atlas response status %d", rsp.StatusCode)
+	}
+	return nil
+}
 
-	us, err := rlmu.New(rsp.Header, s.logger)
+// bootstrap - Probes an upstream key until its rate limiting
+// information is known, backing off exponentially between the
+// failed probes, on the clock of the upstream rate limiters. It gives
+// up as soon as a forwarded request taught the limits to the upstream
+// rate limiter.
+func (s *atlasClient) bootstrap(key *upstreamKey) {
+	clock := s.settings.usRlmSettings.Clock
+	backoff := s.settings.ProbeBackoff
+	for !key.us.Learned() {
+		err := s.probe(key)
+		if err == nil {
+			s.logger.Info("upstream key bootstrapped", zap.Int("key", key.index))
+			return
+		}
+		s.logger.Warn("probing upstream key",
+			zap.Int("key", key.index),
+			zap.Duration("retry", backoff),
+			zap.Error(err))
+		wake := make(chan struct{})
+		clock.AfterFunc(backoff, func() { close(wake) })
+		<-wake
+		backoff = min(2*backoff, s.settings.ProbeMaxBackoff)
+	}
+}
+
+// init - Creates the upstream key pool. The upstream rate limiters
+// start from the configured limits, and are bootstrapped in the
+// background, so that a failing probe neither delays the start
+// nor disables the rate limiting.
+func (s *atlasClient) init() error {
+	s.pool = &upstreamPool{
+		strategy: s.settings.UpstreamSelection,
+		cooldown: s.settings.UpstreamCooldown,
+		logger:   s.logger,
+	}
+	store, err := s.stateStore()
 	if err != nil {
 		return err
 	}
-	s.us = us
-
-	io.Copy(io.Discard, rsp.Body)
+	for i, secret := range s.settings.Secrets {
+		us, err := rlmu.New(s.settings.usRlmSettings, s.logger)
+		if err != nil {
+			return err
+		}
+		if store != nil {
+			if err := us.Restore(context.Background(), store, stateKey(secret)); err != nil {
+				// Start from the configured limits
+				s.logger.Error("restoring upstream key state", zap.Int("key", i), zap.Error(err))
+			}
+		}
+		s.pool.keys = append(s.pool.keys, &upstreamKey{
+			index:  i,
+			secret: secret,
+			us:     us,
+		})
+	}
+	if len(s.pool.keys) == 0 {
+		return errNoUpstreamKey
+	}
+	for _, key := range s.pool.keys {
+		go s.bootstrap(key)
+	}
 	return nil
 }
 
@@ -67,23 +147,121 @@ func newAtlasClient(settings *Settings, logger *zap.Logger) (ac *atlasClient, er
 	ac = &atlasClient{
 		settings: settings,
 		ds:       ds,
+		client:   newHTTPClient(settings.transport),
+		routes:   newRoutes(settings),
 		logger:   logger,
 	}
-	err = ac.init()
+	if err = ac.init(); err != nil {
+		return nil, err
+	}
 	return ac, nil
 }
 
+// fetch - Sends a request to Atlas with a secret. The request is bound to the
+// context of the downstream request, so that a client disconnect
+// cancels the upstream call. An empty acceptEncoding lets the HTTP
+// client negotiate and decode the response encoding. The conditional
+// headers of the downstream request, if not nil, are relayed.
+func (s *atlasClient) fetch(ctx context.Context, secret, path string, values url.Values, acceptEncoding string, conditions http.Header) (*http.Response, error) {
+	// Create Atlas base url for the path
+	baseURL, err := url.Parse(s.settings.URL + path)
+	if err != nil {
+		return nil, err
+	}
+	baseURL.RawQuery = values.Encode()
+	// Create the upstream request, canceled when a read
+	// of its body stalls
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// Set the authentication header
+	req.Header.Add(secretHederKey, secret)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	for _, key := range conditionalHeaders {
+		if val := conditions.Get(key); val != "" {
+			req.Header.Set(key, val)
+		}
+	}
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	rsp.Body = newReadDeadlineBody(rsp.Body, s.settings.transport.BodyReadTimeout, cancel)
+	return rsp, nil
+}
+
+// retryAfter - Formats a duration as the value of a
+// Retry-After header, in whole seconds
+func retryAfter(d time.Duration) string {
+	return fmt.Sprintf("%d", int(math.Ceil(d.Seconds())))
+}
+
+// rateLimitHeaders - Sets the downstream rate limiting
+// headers of a secret on the response
+func (s *atlasClient) rateLimitHeaders(resp http.ResponseWriter, secret string) error {
+	dsInfo, err := s.ds.Info(context.Background(), secret)
+	if err != nil {
+		return err
+	}
+	for k, v := range dsInfo {
+		resp.Header().Set(k, v)
+	}
+	return nil
+}
+
 func (s *atlasClient) forwardRequest(resp http.ResponseWriter, req *http.Request, path string) {
-	status, secret, err := s.ds.Allow(context.Background(), req)
+	// Validate the query parameters
+	q, errs := s.routes[path].validate(req.URL.Query())
+	if len(errs) > 0 {
+		writeErrors(resp, http.StatusBadRequest, errs...)
+		return
+	}
+	// The first Atlas page is charged up front, a request
+	// without take gets a full page
+	take := atlasPageSize
+	if q.take > 0 {
+		take = min(int(q.take), atlasPageSize)
+	}
+	status, grant, err := s.ds.Allow(context.Background(), req, s.cost(req, take))
+	var lockoutErr *rlmd.LockoutError
+	var suspensionErr *rlmd.SuspensionError
+	var stateErr *rlmd.StateError
+	switch {
+	case errors.As(err, &lockoutErr):
+		resp.Header().Set("Retry-After", retryAfter(lockoutErr.RetryAfter))
+		writeError(resp, status, "auth_locked_out", "too many failed authentications")
+		return
+	case errors.As(err, &suspensionErr):
+		resp.Header().Set("Retry-After", retryAfter(suspensionErr.RetryAfter))
+		resp.Header().Set(rateLimitScopeKey, scopePenalty)
+		writeError(resp, status, "secret_suspended", "the secret is suspended after too many denied requests")
+		return
+	case errors.As(err, &stateErr):
+		code, message := secretStateError(stateErr.State)
+		writeError(resp, status, code, message)
+		return
+	case errors.Is(err, rlmd.ErrInvalidSecret):
+		writeError(resp, status, "invalid_secret", "the secret is not valid")
+		return
+	case status == http.StatusBadRequest:
+		writeError(resp, status, "missing_secret", "the request has no secret")
+		return
+	}
 	if err != nil {
 		if errors.Is(err, rlmd.ErrTooManyRequests) {
-			dsInfo, err := s.ds.Info(context.Background(), secret)
-			if err != nil {
+			if err := s.rateLimitHeaders(resp, grant.Secret); err != nil {
 				resp.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			for k, v := range dsInfo {
-				resp.Header().Add(k, v)
+			var limitErr *rlmd.LimitError
+			if errors.As(err, &limitErr) {
+				resp.Header().Set(rateLimitScopeKey, limitErr.Scope)
 			}
 			resp.WriteHeader(status)
 			return
@@ -95,57 +273,40 @@ func (s *atlasClient) forwardRequest(resp http.ResponseWriter, req *http.Request
 		resp.WriteHeader(status)
 		return
 	}
-	// Check if the upstream rate limiter allows this request
-	if !s.us.Slot() {
-		s.logger.Debug("upstream rate limiting: no slots available")
-		resp.WriteHeader(http.StatusTooManyRequests)
-		return
-	}
-	// Create Atlas base url for series
-	baseURL, err := url.Parse(atlasURL + path)
+	s.deprecation(resp, grant)
+	release, err := s.ds.Acquire(req.Context(), grant.Secret)
 	if err != nil {
-		s.logger.Error("url parse", zap.Error(err))
-		resp.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	// Set the query parameters
-	ruValues := url.Values{}
-
-	// Set the "lifecycle" query parameter
-	ruValues.Set("lifecycle", "live")
-	// Add "take" parameters if necessary
-	if req.URL.Query().Has("take") {
-		take, err := strconv.ParseUint(req.URL.Query().Get("take"), 10, 0)
-		if err != nil {
-			s.logger.Error("parse take parameter", zap.Error(err))
-			resp.WriteHeader(http.StatusBadRequest)
+		// The request is not served, the units charged by
+		// Allow are not spent
+		if err := s.ds.Refund(req.Context(), grant); err != nil {
+			s.logger.Warn("refunding request not served", zap.Error(err))
 		}
-		if take > 50 {
-			take = 50
+		var limitErr *rlmd.LimitError
+		if errors.As(err, &limitErr) {
+			resp.Header().Set(rateLimitScopeKey, limitErr.Scope)
+			writeError(resp, http.StatusTooManyRequests, "too_many_requests_in_flight",
+				"too many requests of the secret in flight")
+			return
 		}
-		ruValues.Set("take", fmt.Sprintf("%d", take))
+		s.logger.Error("acquiring a request in flight", zap.Error(err))
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	if req.URL.Query().Has("skip") {
-		skip, err := strconv.ParseUint(req.URL.Query().Get("skip"), 10, 0)
-		if err != nil {
-			s.logger.Error("parse skip parameter", zap.Error(err))
-			resp.WriteHeader(http.StatusBadRequest)
-		}
-		ruValues.Set("skip", fmt.Sprintf("%d", skip))
+	defer release()
+	ticket := s.ticket(grant)
+	if q.take > atlasPageSize {
+		// Atlas does not return more than a page, fan out
+		s.paginate(resp, req, path, q.values, int(q.take), int(q.skip), grant, ticket)
+		return
 	}
-	baseURL.RawQuery = ruValues.Encode()
-	// Create the upstream request
-	newReq, err := http.NewRequest(http.MethodGet, baseURL.String(), nil)
-	if err != nil {
-		s.logger.Error("parse skip parameter", zap.Error(err))
-		resp.WriteHeader(http.StatusInternalServerError)
+	// Send the request to Atlas, if the upstream rate limiters allow
+	// it, negotiating the encodings that can be relayed to the client.
+	newResp, err := s.forward(req.Context(), ticket, path, q.values, upstreamAcceptEncoding(req.Header.Get("Accept-Encoding")), req.Header)
+	if errors.Is(err, errNoUpstreamSlot) || errors.Is(err, errNoUpstreamKey) {
+		s.logger.Debug("upstream rate limiting: no slots available")
+		resp.WriteHeader(http.StatusTooManyRequests)
 		return
 	}
-	// Set the authentication header
-	newReq.Header.Add(secretHederKey, s.settings.Secret)
-	// Send the request to Atlas
-	client := &http.Client{}
-	newResp, err := client.Do(newReq)
 	if err != nil {
 		s.logger.Error("error response from atlas", zap.Error(err))
 		resp.WriteHeader(http.StatusInternalServerError)
@@ -153,26 +314,29 @@ func (s *atlasClient) forwardRequest(resp http.ResponseWriter, req *http.Request
 	}
 	defer newResp.Body.Close()
 	// Check the status code
-	if newResp.StatusCode != http.StatusOK {
-		if newResp.StatusCode == http.StatusTooManyRequests {
-			s.logger.Debug("too many requests from Atlas")
+	if newResp.StatusCode == http.StatusNotModified {
+		// Atlas validated the conditions of the client
+		for _, key := range []string{"ETag", "Last-Modified"} {
+			if val := newResp.Header.Get(key); val != "" {
+				resp.Header().Set(key, val)
+			}
 		}
+		s.writeNotModified(resp, req, grant)
+		return
+	}
+	if newResp.StatusCode != http.StatusOK {
 		resp.WriteHeader(newResp.StatusCode)
 		return
 	}
-	s.us.Update(newResp.Header)
-	dsInfo, err := s.ds.Info(context.Background(), secret)
-	if err != nil {
+	if err := s.rateLimitHeaders(resp, grant.Secret); err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	resp.Header().Add("Content-Type", newResp.Header.Get("Content-Type"))
-	resp.Header().Add("Content-Length", fmt.Sprintf("%d", newResp.ContentLength))
-	for k, v := range dsInfo {
-		resp.Header().Add(k, v)
+	if s.validators(resp, req, newResp) {
+		s.writeNotModified(resp, req, grant)
+		return
 	}
-	io.Copy(resp, newResp.Body)
+	s.streamResponse(resp, req, newResp)
 }
 
 // seriesLiveRequestHandler request handler for endpoint "/series/live"
@@ -199,6 +363,9 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if s.settings.AdminAddr != "" {
+		go s.serveAdmin()
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /series/live", s.seriesLiveRequestHandler)
 	mux.HandleFunc("GET /players/live", s.playersLiveRequestHandler)
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/yambabmay/yyabws/server/rlmd"
+	"github.com/yambabmay/yyabws/server/rlmu"
+	"go.uber.org/zap"
+)
+
+// nextLink - builds the Link header pointing to the records following
+// the ones in the response. The secret is not repeated in the link.
+func nextLink(req *http.Request, take, skip int) string {
+	next := *req.URL
+	values := req.URL.Query()
+	values.Del("secret")
+	values.Set("take", fmt.Sprintf("%d", take))
+	values.Set("skip", fmt.Sprintf("%d", skip))
+	next.RawQuery = values.Encode()
+	return fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI())
+}
+
+// paginate - Collects take records, starting at skip, from as many
+// Atlas pages as necessary and returns them to the client as one JSON
+// array. The pages are requested sequentially. Each one uses an
+// upstream slot on one of the Atlas keys, and every page after the
+// first is charged its cost to the downstream secret, the
+// first one was charged by Allow. The slots of a page that did not
+// reach Atlas are released, and the cost of a page that could not be
+// fetched is refunded. When the budget of either side runs out,
+// the records collected so far are returned with the
+// X-Pagination-Truncated header and a Link to the remaining records.
+func (s *atlasClient) paginate(resp http.ResponseWriter, req *http.Request, path string, values url.Values, take, skip int, grant *rlmd.Grant, ticket rlmu.Ticket) {
+	var records []json.RawMessage
+	pages := 0
+	truncated := false
+	more := false
+	for len(records) < take {
+		pageTake := min(atlasPageSize, take-len(records))
+		cost := s.cost(req, pageTake)
+		if pages > 0 {
+			// The first page was charged by the downstream rate limiter
+			if _, err := s.ds.Consume(req.Context(), grant, cost); err != nil {
+				if !errors.Is(err, rlmd.ErrTooManyRequests) {
+					s.logger.Error("charging page", zap.Error(err))
+				}
+				truncated = true
+				break
+			}
+		}
+		values.Set("take", fmt.Sprintf("%d", pageTake))
+		values.Set("skip", fmt.Sprintf("%d", skip+len(records)))
+		page, status, err := s.fetchPage(req, ticket, path, values)
+		if err != nil {
+			if status == http.StatusTooManyRequests {
+				s.logger.Debug("upstream rate limiting: no slots available")
+			} else {
+				s.logger.Error("error response from atlas", zap.Error(err))
+			}
+			if pages == 0 {
+				resp.WriteHeader(status)
+				return
+			}
+			// The page charged by Consume was not received
+			if err := s.ds.RefundLast(req.Context(), grant); err != nil {
+				s.logger.Warn("refunding page not fetched", zap.Error(err))
+			}
+			truncated = true
+			break
+		}
+		pages++
+		records = append(records, page...)
+		if len(page) < pageTake {
+			// No more records in Atlas
+			break
+		}
+		more = len(records) == take
+	}
+
+	if err := s.rateLimitHeaders(resp, grant.Secret); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("X-Pagination-Pages", fmt.Sprintf("%d", pages))
+	if truncated {
+		resp.Header().Set("X-Pagination-Truncated", "true")
+		resp.Header().Set("Link", nextLink(req, take-len(records), skip+len(records)))
+	} else if more {
+		resp.Header().Set("Link", nextLink(req, take, skip+len(records)))
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	compress := accepts(acceptedEncodings(req.Header.Get("Accept-Encoding")), "gzip")
+	etag := strongETag(body)
+	if compress {
+		etag = etagWithSuffix(etag, "-gzip")
+	}
+	resp.Header().Set("ETag", etag)
+	if notModified(req, etag, "") {
+		s.writeNotModified(resp, req, grant)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Add("Vary", "Accept-Encoding")
+	if compress {
+		resp.Header().Set("Content-Encoding", "gzip")
+	} else {
+		resp.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	}
+	resp.WriteHeader(http.StatusOK)
+
+	out := newFlushWriter(resp, compress)
+	defer out.Close()
+	if _, err := out.Write(body); err != nil {
+		s.logger.Debug("streaming response", zap.Error(err))
+	}
+}
+
+// fetchPage - Requests a page of records from Atlas, if the upstream
+// rate limiters allow it. On error, the returned status is the one to
+// send to the client.
+func (s *atlasClient) fetchPage(req *http.Request, ticket rlmu.Ticket, path string, values url.Values) ([]json.RawMessage, int, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), s.settings.transport.Timeout)
+	defer cancel()
+	rsp, err := s.forward(ctx, ticket, path, values, "", nil)
+	if errors.Is(err, errNoUpstreamSlot) || errors.Is(err, errNoUpstreamKey) {
+		return nil, http.StatusTooManyRequests, err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, rsp.StatusCode, fmt.Errorf("atlas response status %d", rsp.StatusCode)
+	}
+	var page []json.RawMessage
+	if err := json.NewDecoder(rsp.Body).Decode(&page); err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	return page, http.StatusOK, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yambabmay/yyabws/server/rlmd"
+	"github.com/yambabmay/yyabws/server/rlmu"
+	"go.uber.org/zap"
+)
+
+// Upstream key selection strategies
+const (
+	selectLeastLoaded = "least-loaded"
+	selectRoundRobin  = "round-robin"
+)
+
+var (
+	errNoUpstreamSlot = errors.New("no upstream slot available")
+	errNoUpstreamKey  = errors.New("no upstream key available")
+)
+
+// upstreamKey - An Atlas secret and its upstream rate limiter
+type upstreamKey struct {
+	// index of the key in the pool, used in the logs
+	// instead of the secret
+	index  int
+	secret string
+	us     *rlmu.RateLimiter
+	// inflight the number of requests sent with the key
+	// and not answered yet
+	inflight int
+	// disabledUntil is set when Atlas rejects the key
+	disabledUntil time.Time
+}
+
+// upstreamPool - The Atlas secrets the requests are spread across
+type upstreamPool struct {
+	sync.Mutex
+	keys     []*upstreamKey
+	next     int
+	strategy string
+	// cooldown the time a key rejected by Atlas is not used
+	cooldown time.Duration
+	logger   *zap.Logger
+}
+
+// candidates - Returns the keys that are not disabled, in the order
+// they should be tried according to the selection strategy.
+func (s *upstreamPool) candidates() []*upstreamKey {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	var keys []*upstreamKey
+	for i := range s.keys {
+		key := s.keys[(s.next+i)%len(s.keys)]
+		if key.disabledUntil.After(now) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if s.strategy == selectRoundRobin {
+		s.next = (s.next + 1) % len(s.keys)
+		return keys
+	}
+	// The key with the most free slots first, then the
+	// one with the least requests in flight.
+	available := make(map[*upstreamKey]int, len(keys))
+	for _, key := range keys {
+		available[key] = key.us.Available()
+	}
+	slices.SortStableFunc(keys, func(a, b *upstreamKey) int {
+		if available[a] != available[b] {
+			return available[b] - available[a]
+		}
+		return a.inflight - b.inflight
+	})
+	return keys
+}
+
+// acquire - Reserves an upstream slot on one of the keys. The keys
+// are first tried without waiting, if none of them has a free slot the
+// request waits in the slot queue of the preferred key.
+func (s *upstreamPool) acquire(ticket rlmu.Ticket, skip []*upstreamKey) (*upstreamKey, *rlmu.Reservation, error) {
+	var keys []*upstreamKey
+	for _, key := range s.candidates() {
+		if !slices.Contains(skip, key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, errNoUpstreamKey
+	}
+	for _, key := range keys {
+		if r := key.us.TryReserve(ticket); r != nil {
+			s.started(key)
+			return key, r, nil
+		}
+	}
+	r, err := keys[0].us.Reserve(ticket)
+	if err != nil {
+		return nil, nil, errNoUpstreamSlot
+	}
+	s.started(keys[0])
+	return keys[0], r, nil
+}
+
+// started - Records a request sent with the key
+func (s *upstreamPool) started(key *upstreamKey) {
+	s.Lock()
+	defer s.Unlock()
+	key.inflight++
+}
+
+// done - Records the response to a request sent with the key
+func (s *upstreamPool) done(key *upstreamKey) {
+	s.Lock()
+	defer s.Unlock()
+	key.inflight--
+}
+
+// disable - Stops using a key rejected by Atlas for the cooldown period
+func (s *upstreamPool) disable(key *upstreamKey, status int) {
+	s.Lock()
+	defer s.Unlock()
+	key.disabledUntil = time.Now().Add(s.cooldown)
+	s.logger.Warn("atlas rejected upstream key",
+		zap.Int("key", key.index),
+		zap.Int("status", status),
+		zap.Duration("cooldown", s.cooldown))
+}
+
+// ticket - Makes the ticket of the upstream slots of a request. Its
+// priority and weight are the ones of the plan of the downstream secret,
+// and each downstream account is a flow of its own, so that the queued
+// accounts get a fair share of the upstream slots, whatever the number
+// of their rotated secrets.
+func (s *atlasClient) ticket(grant *rlmd.Grant) rlmu.Ticket {
+	return rlmu.Ticket{
+		Priority: s.settings.PlanPriorities[grant.Plan],
+		Flow:     grant.Account,
+		Weight:   s.settings.PlanWeights[grant.Plan],
+		Plan:     grant.Plan,
+	}
+}
+
+// forward - Sends a request to Atlas with one of the keys of the pool.
+// A key that is rate limited or rejected by Atlas fails over to the
+// next one. Every response updates the upstream rate limiter of the key
+// it was sent with, and steers its adaptive limit when Atlas does not
+// publish its limits. The slot of a request that was never written to
+// Atlas is released, so that it is not wasted.
+func (s *atlasClient) forward(ctx context.Context, ticket rlmu.Ticket, path string, values url.Values, acceptEncoding string, conditions http.Header) (*http.Response, error) {
+	var tried []*upstreamKey
+	for {
+		key, reservation, err := s.pool.acquire(ticket, tried)
+		if err != nil {
+			if errors.Is(err, errNoUpstreamKey) && len(tried) > 0 {
+				// Every key was rate limited or rejected
+				return nil, errNoUpstreamSlot
+			}
+			return nil, err
+		}
+		tried = append(tried, key)
+		rsp, err := s.send(ctx, key, reservation, path, values, acceptEncoding, conditions)
+		s.pool.done(key)
+		if err != nil {
+			return nil, err
+		}
+		switch rsp.StatusCode {
+		case http.StatusOK, http.StatusNotModified:
+			key.us.Update(rsp.Header)
+			return rsp, nil
+		case http.StatusTooManyRequests:
+			s.logger.Debug("too many requests from Atlas", zap.Int("key", key.index))
+			// Let the limiter honor the "Retry-After" header
+			key.us.Update(rsp.Header)
+		case http.StatusUnauthorized, http.StatusForbidden:
+			s.pool.disable(key, rsp.StatusCode)
+		default:
+			return rsp, nil
+		}
+		if len(tried) == len(s.pool.keys) {
+			return rsp, nil
+		}
+		rsp.Body.Close()
+	}
+}
+
+// send - Sends a request to Atlas with a key, on a slot reserved on
+// its upstream rate limiter. The slot is released if the request was
+// never written to Atlas, and committed otherwise. The outcome steers
+// the adaptive limit of the key.
+func (s *atlasClient) send(ctx context.Context, key *upstreamKey, reservation *rlmu.Reservation, path string, values url.Values, acceptEncoding string, conditions http.Header) (*http.Response, error) {
+	var wrote atomic.Bool
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { wrote.Store(true) },
+	}
+	start := time.Now()
+	rsp, err := s.fetch(httptrace.WithClientTrace(ctx, trace), key.secret, path, values, acceptEncoding, conditions)
+	latency := time.Since(start)
+	if err != nil {
+		if wrote.Load() {
+			reservation.Commit()
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				// Atlas did not answer in time
+				key.us.Observe(http.StatusGatewayTimeout, latency)
+			}
+		} else {
+			// Atlas did not count the request
+			reservation.Release()
+		}
+		return nil, err
+	}
+	reservation.Commit()
+	key.us.Observe(rsp.StatusCode, latency)
+	return rsp, nil
+}
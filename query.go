@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// paramKind - The type of a query parameter
+type paramKind int
+
+const (
+	// An unsigned integer in the range [min, max]
+	paramUint paramKind = iota
+	// One of a fixed set of values
+	paramEnum
+	// An Atlas filter expression
+	paramFilter
+	// An Atlas ordering expression
+	paramOrder
+)
+
+// fieldType - The type of a field that can be filtered on
+type fieldType int
+
+const (
+	fieldInt fieldType = iota
+	fieldString
+	fieldTime
+	fieldBool
+)
+
+// paramSpec - The schema of a query parameter
+type paramSpec struct {
+	name string
+	kind paramKind
+	// bounds of a paramUint, max 0 means no upper bound
+	min, max uint64
+	// values allowed for a paramEnum
+	values []string
+	// fields allowed in a paramFilter or a paramOrder
+	fields map[string]fieldType
+	// def is set upstream when the parameter is missing
+	def string
+}
+
+// route - A proxied endpoint and the schema of its query
+type route struct {
+	// Atlas path of the endpoint
+	path   string
+	params []paramSpec
+}
+
+// query - The validated query of a downstream request
+type query struct {
+	// values forwarded to Atlas
+	values url.Values
+	// take and skip, zero when missing
+	take, skip uint64
+}
+
+// Parameters that are consumed by the proxy and not forwarded
+var proxyParams = []string{"secret"}
+
+// Filter operators, the longest ones first so that
+// they are matched before their prefixes
+var filterOperators = []string{"!=", "<=", ">=", "=", "<", ">"}
+
+// newRoutes - Creates the routes served by the proxy, keyed by
+// their Atlas path.
+func newRoutes(settings *Settings) map[string]*route {
+	paging := []paramSpec{
+		{name: "take", kind: paramUint, min: 1, max: uint64(settings.MaxTake)},
+		{name: "skip", kind: paramUint},
+		{name: "lifecycle", kind: paramEnum, values: []string{"live"}, def: "live"},
+	}
+	series := map[string]fieldType{
+		"id":            fieldInt,
+		"title":         fieldString,
+		"start":         fieldTime,
+		"end":           fieldTime,
+		"game.id":       fieldInt,
+		"tournament.id": fieldInt,
+		"stage.id":      fieldInt,
+		"substage.id":   fieldInt,
+		"postponed":     fieldBool,
+	}
+	players := map[string]fieldType{
+		"id":        fieldInt,
+		"nick_name": fieldString,
+		"game.id":   fieldInt,
+		"team.id":   fieldInt,
+		"region.id": fieldInt,
+	}
+	teams := map[string]fieldType{
+		"id":           fieldInt,
+		"name":         fieldString,
+		"abbreviation": fieldString,
+		"game.id":      fieldInt,
+		"region.id":    fieldInt,
+	}
+	routes := make(map[string]*route)
+	for path, fields := range map[string]map[string]fieldType{
+		"/series":  series,
+		"/players": players,
+		"/teams":   teams,
+	} {
+		params := slices.Clone(paging)
+		params = append(params,
+			paramSpec{name: "filter", kind: paramFilter, fields: fields},
+			paramSpec{name: "order", kind: paramOrder, fields: fields},
+		)
+		routes[path] = &route{path: path, params: params}
+	}
+	return routes
+}
+
+// validate - Parses, bounds-checks and normalizes the query of a
+// downstream request. Only the parameters of the route schema are
+// forwarded, any other parameter is an error.
+func (s *route) validate(values url.Values) (*query, []apiError) {
+	q := &query{values: url.Values{}}
+	var errs []apiError
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if slices.Contains(proxyParams, name) {
+			continue
+		}
+		if !slices.ContainsFunc(s.params, func(p paramSpec) bool { return p.name == name }) {
+			errs = append(errs, apiError{
+				Code:      "unknown_parameter",
+				Message:   fmt.Sprintf("parameter %q is not supported", name),
+				Parameter: name,
+			})
+		}
+	}
+	for _, spec := range s.params {
+		if !values.Has(spec.name) {
+			if spec.def != "" {
+				q.values.Set(spec.name, spec.def)
+			}
+			continue
+		}
+		if len(values[spec.name]) > 1 {
+			errs = append(errs, apiError{
+				Code:      "repeated_parameter",
+				Message:   fmt.Sprintf("parameter %q is repeated", spec.name),
+				Parameter: spec.name,
+			})
+			continue
+		}
+		normalized, err := spec.normalize(strings.TrimSpace(values.Get(spec.name)))
+		if err != nil {
+			errs = append(errs, apiError{
+				Code:      "invalid_parameter",
+				Message:   err.Error(),
+				Parameter: spec.name,
+			})
+			continue
+		}
+		q.values.Set(spec.name, normalized)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if q.values.Has("take") {
+		q.take, _ = strconv.ParseUint(q.values.Get("take"), 10, 0)
+	}
+	if q.values.Has("skip") {
+		q.skip, _ = strconv.ParseUint(q.values.Get("skip"), 10, 0)
+	}
+	return q, nil
+}
+
+// normalize - Validates a parameter value and returns its
+// canonical form.
+func (s *paramSpec) normalize(value string) (string, error) {
+	switch s.kind {
+	case paramUint:
+		n, err := strconv.ParseUint(value, 10, 0)
+		if err != nil {
+			return "", fmt.Errorf("%q is not an unsigned integer", value)
+		}
+		if n < s.min || (s.max > 0 && n > s.max) {
+			if s.max > 0 {
+				return "", fmt.Errorf("%d is not in the range [%d .. %d]", n, s.min, s.max)
+			}
+			return "", fmt.Errorf("%d is less than %d", n, s.min)
+		}
+		return strconv.FormatUint(n, 10), nil
+	case paramEnum:
+		value = strings.ToLower(value)
+		if !slices.Contains(s.values, value) {
+			return "", fmt.Errorf("%q is not one of %s", value, strings.Join(s.values, ", "))
+		}
+		return value, nil
+	case paramFilter:
+		return s.normalizeFilter(value)
+	case paramOrder:
+		return s.normalizeOrder(value)
+	}
+	return "", fmt.Errorf("unsupported parameter %q", s.name)
+}
+
+// normalizeFilter - Validates an Atlas filter expression, a comma
+// separated list of conditions "<field><operator><value>". A value
+// in braces, "{1,2,3}", is a set and is only allowed with the = and
+// != operators.
+func (s *paramSpec) normalizeFilter(value string) (string, error) {
+	conditions, err := splitFilter(value)
+	if err != nil {
+		return "", err
+	}
+	for i, condition := range conditions {
+		field, operator, operand, ok := cutOperator(condition)
+		if !ok {
+			return "", fmt.Errorf("condition %q has no operator", condition)
+		}
+		typ, ok := s.fields[field]
+		if !ok {
+			return "", fmt.Errorf("can not filter on field %q", field)
+		}
+		if strings.HasPrefix(operand, "{") && strings.HasSuffix(operand, "}") {
+			if operator != "=" && operator != "!=" {
+				return "", fmt.Errorf("operator %q does not apply to a set", operator)
+			}
+			var members []string
+			for _, member := range strings.Split(operand[1:len(operand)-1], ",") {
+				member, err := normalizeOperand(typ, strings.TrimSpace(member))
+				if err != nil {
+					return "", fmt.Errorf("field %q: %v", field, err)
+				}
+				members = append(members, member)
+			}
+			operand = "{" + strings.Join(members, ",") + "}"
+		} else {
+			if typ == fieldBool || typ == fieldString {
+				if operator != "=" && operator != "!=" {
+					return "", fmt.Errorf("operator %q does not apply to field %q", operator, field)
+				}
+			}
+			operand, err = normalizeOperand(typ, operand)
+			if err != nil {
+				return "", fmt.Errorf("field %q: %v", field, err)
+			}
+		}
+		conditions[i] = field + operator + operand
+	}
+	return strings.Join(conditions, ","), nil
+}
+
+// splitFilter - Splits a filter expression on the commas that are
+// not inside a set.
+func splitFilter(value string) ([]string, error) {
+	var conditions []string
+	depth := 0
+	start := 0
+	for i, c := range value {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced braces in %q", value)
+			}
+		case ',':
+			if depth == 0 {
+				conditions = append(conditions, strings.TrimSpace(value[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced braces in %q", value)
+	}
+	conditions = append(conditions, strings.TrimSpace(value[start:]))
+	for _, condition := range conditions {
+		if condition == "" {
+			return nil, fmt.Errorf("empty condition in %q", value)
+		}
+	}
+	return conditions, nil
+}
+
+// cutOperator - Splits a condition into its field, operator and operand
+func cutOperator(condition string) (field, operator, operand string, ok bool) {
+	for i := range condition {
+		for _, op := range filterOperators {
+			if strings.HasPrefix(condition[i:], op) {
+				field = strings.TrimSpace(condition[:i])
+				operand = strings.TrimSpace(condition[i+len(op):])
+				return field, op, operand, field != "" && operand != ""
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+// normalizeOperand - Validates an operand against the type of the
+// field it is compared with.
+func normalizeOperand(typ fieldType, operand string) (string, error) {
+	if operand == "" {
+		return "", fmt.Errorf("empty value")
+	}
+	switch typ {
+	case fieldInt:
+		n, err := strconv.ParseInt(operand, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%q is not an integer", operand)
+		}
+		return strconv.FormatInt(n, 10), nil
+	case fieldTime:
+		t, err := time.Parse(time.RFC3339, operand)
+		if err != nil {
+			return "", fmt.Errorf("%q is not an RFC 3339 time", operand)
+		}
+		return t.UTC().Format(time.RFC3339), nil
+	case fieldBool:
+		b, err := strconv.ParseBool(operand)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a boolean", operand)
+		}
+		return strconv.FormatBool(b), nil
+	}
+	if strings.ContainsAny(operand, "{},") {
+		return "", fmt.Errorf("%q contains reserved characters", operand)
+	}
+	return operand, nil
+}
+
+// normalizeOrder - Validates an Atlas ordering expression, a comma
+// separated list of "<field>-asc" or "<field>-desc".
+func (s *paramSpec) normalizeOrder(value string) (string, error) {
+	terms := strings.Split(value, ",")
+	for i, term := range terms {
+		term = strings.TrimSpace(term)
+		field, direction, ok := cutLast(term, "-")
+		if !ok || (direction != "asc" && direction != "desc") {
+			return "", fmt.Errorf("order %q is not <field>-asc or <field>-desc", term)
+		}
+		if _, ok := s.fields[field]; !ok {
+			return "", fmt.Errorf("can not order on field %q", field)
+		}
+		terms[i] = field + "-" + direction
+	}
+	return strings.Join(terms, ","), nil
+}
+
+// cutLast - Slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], strings.ToLower(s[i+len(sep):]), true
+	}
+	return s, "", false
+}
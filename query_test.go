@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSplitFilter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+		err   bool
+	}{
+		{value: "id=1", want: []string{"id=1"}},
+		{value: "id=1, game.id=2", want: []string{"id=1", "game.id=2"}},
+		{value: "id={1,2,3},title=x", want: []string{"id={1,2,3}", "title=x"}},
+		{value: "id={1,{2}}", want: []string{"id={1,{2}}"}},
+		{value: "id={1,2", err: true},
+		{value: "id=1}", err: true},
+		{value: "id=}1{", err: true},
+		{value: "id=1,,title=x", err: true},
+		{value: "id=1,", err: true},
+		{value: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := splitFilter(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("splitFilter(%q) error = %v, want error %v", tt.value, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitFilter(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCutOperator(t *testing.T) {
+	tests := []struct {
+		condition string
+		field     string
+		operator  string
+		operand   string
+		ok        bool
+	}{
+		{condition: "id=1", field: "id", operator: "=", operand: "1", ok: true},
+		{condition: "id!=1", field: "id", operator: "!=", operand: "1", ok: true},
+		{condition: "start>=2024", field: "start", operator: ">=", operand: "2024", ok: true},
+		{condition: "start<=2024", field: "start", operator: "<=", operand: "2024", ok: true},
+		{condition: "start>2024", field: "start", operator: ">", operand: "2024", ok: true},
+		{condition: "start<2024", field: "start", operator: "<", operand: "2024", ok: true},
+		{condition: " id = 1 ", field: "id", operator: "=", operand: "1", ok: true},
+		// The first operator wins, the operand keeps the others
+		{condition: "title==x", field: "title", operator: "=", operand: "=x", ok: true},
+		{condition: "id", ok: false},
+		{condition: "=1", operator: "=", operand: "1", ok: false},
+		{condition: "id=", field: "id", operator: "=", ok: false},
+	}
+	for _, tt := range tests {
+		field, operator, operand, ok := cutOperator(tt.condition)
+		if field != tt.field || operator != tt.operator || operand != tt.operand || ok != tt.ok {
+			t.Errorf("cutOperator(%q) = %q, %q, %q, %v, want %q, %q, %q, %v", tt.condition,
+				field, operator, operand, ok, tt.field, tt.operator, tt.operand, tt.ok)
+		}
+	}
+}
+
+func TestNormalizeFilter(t *testing.T) {
+	spec := &paramSpec{name: "filter", kind: paramFilter, fields: map[string]fieldType{
+		"id":        fieldInt,
+		"title":     fieldString,
+		"start":     fieldTime,
+		"postponed": fieldBool,
+	}}
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{value: "id=007", want: "id=7"},
+		{value: "id = 1 , title = abc", want: "id=1,title=abc"},
+		{value: "id>-3", want: "id>-3"},
+		{value: "id={3, 02,1}", want: "id={3,2,1}"},
+		{value: "id!={1,2}", want: "id!={1,2}"},
+		{value: "start>=2024-01-01T02:00:00+02:00", want: "start>=2024-01-01T00:00:00Z"},
+		{value: "postponed=1", want: "postponed=true"},
+		{value: "title!={a,b}", want: "title!={a,b}"},
+		{value: "id>{1,2}", err: true},
+		{value: "id=x", err: true},
+		{value: "id={1,x}", err: true},
+		{value: "id={}", err: true},
+		{value: "title>abc", err: true},
+		{value: "postponed<true", err: true},
+		{value: "postponed=maybe", err: true},
+		{value: "start=2024-01-01", err: true},
+		{value: "name=abc", err: true},
+		{value: "id", err: true},
+		{value: "id={1,2", err: true},
+		{value: "title=a{b", err: true},
+	}
+	for _, tt := range tests {
+		got, err := spec.normalizeFilter(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("normalizeFilter(%q) error = %v, want error %v", tt.value, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeFilter(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeOrder(t *testing.T) {
+	spec := &paramSpec{name: "order", kind: paramOrder, fields: map[string]fieldType{
+		"id":      fieldInt,
+		"game.id": fieldInt,
+	}}
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{value: "id-asc", want: "id-asc"},
+		{value: "id-DESC, game.id-asc", want: "id-desc,game.id-asc"},
+		{value: "id", err: true},
+		{value: "id-up", err: true},
+		{value: "name-asc", err: true},
+		{value: "id-asc,", err: true},
+	}
+	for _, tt := range tests {
+		got, err := spec.normalizeOrder(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("normalizeOrder(%q) error = %v, want error %v", tt.value, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeOrder(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	route := newRoutes(&Settings{MaxTake: 200})["/series"]
+	tests := []struct {
+		name   string
+		query  string
+		values url.Values
+		take   uint64
+		skip   uint64
+		codes  []string
+	}{
+		{
+			name:   "defaults",
+			query:  "",
+			values: url.Values{"lifecycle": {"live"}},
+		},
+		{
+			name:   "secret not forwarded",
+			query:  "secret=abc&take=010&skip=5&lifecycle=LIVE",
+			values: url.Values{"take": {"10"}, "skip": {"5"}, "lifecycle": {"live"}},
+			take:   10,
+			skip:   5,
+		},
+		{
+			name:   "filter and order normalized",
+			query:  "filter=game.id%3D01&order=start-DESC",
+			values: url.Values{"lifecycle": {"live"}, "filter": {"game.id=1"}, "order": {"start-desc"}},
+		},
+		{name: "unknown parameter", query: "page=2", codes: []string{"unknown_parameter"}},
+		{name: "repeated parameter", query: "take=1&take=2", codes: []string{"repeated_parameter"}},
+		{name: "take above max", query: "take=201", codes: []string{"invalid_parameter"}},
+		{name: "take zero", query: "take=0", codes: []string{"invalid_parameter"}},
+		{name: "negative skip", query: "skip=-1", codes: []string{"invalid_parameter"}},
+		{name: "unknown lifecycle", query: "lifecycle=past", codes: []string{"invalid_parameter"}},
+		{name: "field of another route", query: "filter=nick_name%3Dx", codes: []string{"invalid_parameter"}},
+		{
+			name:  "every error reported",
+			query: "page=2&take=x&take=y&filter=id",
+			codes: []string{"unknown_parameter", "repeated_parameter", "invalid_parameter"},
+		},
+	}
+	for _, tt := range tests {
+		values, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, errs := route.validate(values)
+		var codes []string
+		for _, e := range errs {
+			codes = append(codes, e.Code)
+		}
+		if !reflect.DeepEqual(codes, tt.codes) {
+			t.Errorf("%s: error codes = %q, want %q", tt.name, codes, tt.codes)
+			continue
+		}
+		if tt.codes != nil {
+			continue
+		}
+		if !reflect.DeepEqual(q.values, tt.values) || q.take != tt.take || q.skip != tt.skip {
+			t.Errorf("%s: query = %v take %d skip %d, want %v take %d skip %d",
+				tt.name, q.values, q.take, q.skip, tt.values, tt.take, tt.skip)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package rlmd
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// lockoutMemory - the time after its last lockout the
+// lockouts of a client stop escalating
+const lockoutMemory = 24 * time.Hour
+
+// negativeCacheMax - the maximum number of secrets in
+// the negative cache
+const negativeCacheMax = 10000
+
+var (
+	// authFailures - the number of requests with an invalid secret
+	authFailures = expvar.NewInt("rlmd_auth_failures")
+	// authLockouts - the number of clients locked out
+	authLockouts = expvar.NewInt("rlmd_auth_lockouts")
+	// authLockedOut - the number of requests of locked out clients
+	authLockedOut = expvar.NewInt("rlmd_auth_locked_out")
+	// negativeCacheHits - the number of invalid secrets answered
+	// from the negative cache
+	negativeCacheHits = expvar.NewInt("rlmd_negative_cache_hits")
+)
+
+// ipToFailuresKey - make redis key of the count of failed
+// authentications of a client IP
+func ipToFailuresKey(ip string) string {
+	return "auth:failures:" + ip
+}
+
+// ipToLockoutKey - make redis key of the lockout of a client IP
+func ipToLockoutKey(ip string) string {
+	return "auth:lockout:" + ip
+}
+
+// ipToLevelKey - make redis key of the number of lockouts of a client IP
+func ipToLevelKey(ip string) string {
+	return "auth:level:" + ip
+}
+
+// clientIP - returns the IP address of the client of a request.
+// Behind trusted proxies, it is the rightmost address of the
+// X-Forwarded-For header that is not one of theirs, the addresses on
+// its left could be forged by the client.
+func (s *RateLimiter) clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !s.trusted(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		ip = addr
+		if !s.trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// trusted - returns true if the IP address is the one
+// of a trusted proxy
+func (s *RateLimiter) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.auth.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// negativeCache - The secrets that recently failed authentication.
+// They are rejected again without looking them up in redis.
+type negativeCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	secrets *ttlMap[struct{}]
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{ttl: ttl, secrets: newTTLMap[struct{}](negativeCacheMax)}
+}
+
+// has - returns true if the secret failed authentication recently
+func (s *negativeCache) has(secret string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.secrets.get(secret, time.Now())
+	return ok
+}
+
+// add - records a secret that failed authentication
+func (s *negativeCache) add(secret string) {
+	if s.ttl <= 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.secrets.add(secret, struct{}{}, now.Add(s.ttl), now)
+}
+
+// lockedOut - returns the time the client IP is still locked out for,
+// 0 if it is not.
+func (s *RateLimiter) lockedOut(ctx context.Context, ip string) (time.Duration, error) {
+	if s.auth.MaxFailures <= 0 {
+		return 0, nil
+	}
+	ttl, err := s.client.PTTL(ctx, ipToLockoutKey(ip)).Result()
+	if err != nil {
+		return 0, err
+	}
+	// A missing key has a negative TTL
+	return max(ttl, 0), nil
+}
+
+// authFailed - Records a failed authentication of a client IP. After
+// MaxFailures failures within the FailureWindow the client is locked
+// out, for a time doubling with each lockout, up to MaxLockout.
+func (s *RateLimiter) authFailed(ctx context.Context, ip string) error {
+	authFailures.Add(1)
+	if s.auth.MaxFailures <= 0 {
+		return nil
+	}
+	failuresKey := ipToFailuresKey(ip)
+	levelKey := ipToLevelKey(ip)
+
+	txf := func(tx *redis.Tx) error {
+		failures, err := tx.Get(ctx, failuresKey).Int()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		level, err := tx.Get(ctx, levelKey).Int()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			if failures+1 < s.auth.MaxFailures {
+				if failures > 0 {
+					p.Incr(ctx, failuresKey)
+				} else {
+					p.Set(ctx, failuresKey, 1, s.auth.FailureWindow)
+				}
+				return nil
+			}
+			lockout := s.auth.Lockout
+			for i := 0; i < level && lockout < s.auth.MaxLockout; i++ {
+				lockout *= 2
+			}
+			lockout = min(lockout, s.auth.MaxLockout)
+			p.Set(ctx, ipToLockoutKey(ip), 1, lockout)
+			p.Set(ctx, levelKey, level+1, lockoutMemory)
+			p.Del(ctx, failuresKey)
+			s.logger.Warn("locking out client after failed authentications",
+				zap.String("ip", ip),
+				zap.Int("level", level+1),
+				zap.Duration("lockout", lockout))
+			authLockouts.Add(1)
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < s.mxr; i++ {
+		err := s.client.Watch(ctx, txf, failuresKey, levelKey)
+		if err == nil {
+			return nil
+		}
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return err
+	}
+	return errors.New("transaction maximum retries")
+}
+
+// authenticate - Checks the secret of a request. A locked out client
+// IP is told to retry later, whatever the secret, so that it learns
+// nothing. The invalid secrets are kept in the negative cache and
+// counted against the client IP, the known ones that are not active
+// are not.
+func (s *RateLimiter) authenticate(ctx context.Context, req *http.Request, secret string) (int, *Secret, error) {
+	ip := s.clientIP(req)
+	lockout, err := s.lockedOut(ctx, ip)
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	if lockout > 0 && !s.shadowed("locked out client",
+		zap.String("ip", ip),
+		zap.Duration("lockout", lockout)) {
+		authLockedOut.Add(1)
+		return http.StatusTooManyRequests, nil, &LockoutError{RetryAfter: lockout}
+	}
+	if s.negative.has(secret) {
+		negativeCacheHits.Add(1)
+		return s.rejectSecret(ctx, ip, fmt.Errorf("%w: recently failed", ErrInvalidSecret))
+	}
+	status, info, err := s.CheckSecret(ctx, secret)
+	if status == http.StatusForbidden && !errors.Is(err, ErrInactiveSecret) {
+		s.negative.add(secret)
+		return s.rejectSecret(ctx, ip, fmt.Errorf("%w: %v", ErrInvalidSecret, err))
+	}
+	return status, info, err
+}
+
+// rejectSecret - Rejects a request with an invalid secret, recording
+// the failed authentication against the client IP.
+func (s *RateLimiter) rejectSecret(ctx context.Context, ip string, err error) (int, *Secret, error) {
+	if err := s.authFailed(ctx, ip); err != nil {
+		s.logger.Warn("recording failed authentication", zap.Error(err))
+	}
+	return http.StatusForbidden, nil, err
+}
+
+// AuthSettings - The settings of the protection against
+// the enumeration of the secrets
+type AuthSettings struct {
+	// MaxFailures The number of failed authentications within the
+	// FailureWindow after which a client IP is locked out, 0 for
+	// no lockout. A locked out client IP is rejected whatever its
+	// secret. Behind a proxy, the client IPs are only known when the
+	// proxy is listed in the TrustedProxies.
+	// Configurable through the environment
+	// variable DS_AUTH_MAX_FAILURES, defaults to 0
+	MaxFailures int
+	// FailureWindow The window the failed authentications are counted in
+	// Configurable through the environment
+	// variable DS_AUTH_FAILURE_WINDOW, defaults to 1m
+	FailureWindow time.Duration
+	// Lockout The duration of the first lockout of a client IP, it
+	// doubles with each lockout in the following day
+	// Configurable through the environment
+	// variable DS_AUTH_LOCKOUT, defaults to 1m
+	Lockout time.Duration
+	// MaxLockout The maximum duration of a lockout
+	// Configurable through the environment
+	// variable DS_AUTH_MAX_LOCKOUT, defaults to 1h
+	MaxLockout time.Duration
+	// NegativeCacheTTL The time a secret that failed authentication is
+	// rejected without looking it up, 0 for no negative cache. A
+	// secret added to the database is rejected during that time.
+	// Configurable through the environment
+	// variable DS_NEGATIVE_CACHE_TTL, defaults to 1m
+	NegativeCacheTTL time.Duration
+	// TrustedProxies The networks of the proxies in front of this
+	// one. The client IP of a request coming through them is taken
+	// from the X-Forwarded-For header.
+	// Configurable through the environment variable
+	// DS_AUTH_TRUSTED_PROXIES, a comma separated list of CIDRs,
+	// defaults to none
+	TrustedProxies []*net.IPNet
+}
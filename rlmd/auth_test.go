@@ -0,0 +1,52 @@
+package rlmd
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	var proxies []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "fd00::/8"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxies = append(proxies, network)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{name: "direct", remote: "203.0.113.7:4000", want: "203.0.113.7"},
+		{name: "no port", remote: "203.0.113.7", want: "203.0.113.7"},
+		{name: "untrusted forwarder", remote: "203.0.113.7:4000", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "proxy", remote: "10.0.0.1:4000", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "proxy without header", remote: "10.0.0.1:4000", want: "10.0.0.1"},
+		{name: "forged left", remote: "10.0.0.1:4000", forwarded: []string{"192.0.2.1, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "proxy chain", remote: "10.0.0.1:4000", forwarded: []string{"198.51.100.1, 10.0.0.3, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "several headers", remote: "10.0.0.1:4000", forwarded: []string{"192.0.2.1", "198.51.100.1, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "empty entries", remote: "10.0.0.1:4000", forwarded: []string{"198.51.100.1, ,"}, want: "198.51.100.1"},
+		{name: "only proxies", remote: "10.0.0.1:4000", forwarded: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "ipv6 proxy", remote: "[fd00::1]:4000", forwarded: []string{"2001:db8::1"}, want: "2001:db8::1"},
+	}
+	s := &RateLimiter{auth: AuthSettings{TrustedProxies: proxies}}
+	for _, tt := range tests {
+		req := &http.Request{RemoteAddr: tt.remote, Header: http.Header{}}
+		for _, value := range tt.forwarded {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if got := s.clientIP(req); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	// Without trusted proxies the header is ignored
+	s = &RateLimiter{}
+	req := &http.Request{RemoteAddr: "10.0.0.1:4000", Header: http.Header{"X-Forwarded-For": {"198.51.100.1"}}}
+	if got := s.clientIP(req); got != "10.0.0.1" {
+		t.Errorf("clientIP without trusted proxies = %q, want %q", got, "10.0.0.1")
+	}
+}
@@ -1,7 +1,89 @@
 package rlmd
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 var (
 	ErrTooManyRequests = errors.New("too many requests")
+	ErrInvalidSecret   = errors.New("invalid secret")
+	ErrLockedOut       = errors.New("locked out after failed authentications")
+	ErrSuspended       = errors.New("suspended after too many denied requests")
+	ErrInactiveSecret  = errors.New("inactive secret")
+	ErrRotated         = errors.New("secret already rotated")
+)
+
+// The scopes of the requests per second limits
+const (
+	// ScopeSecret the limit of a secret
+	ScopeSecret = "secret"
+	// ScopeGlobal the limit of all the secrets together
+	ScopeGlobal = "global"
+	// ScopeEndpoint the limit of all the secrets together on an endpoint
+	ScopeEndpoint = "endpoint"
+	// ScopeConcurrency the limit of the requests of a secret in flight
+	ScopeConcurrency = "concurrency"
 )
+
+// LimitError - A request denied by a requests per second limit
+type LimitError struct {
+	// Scope of the limit that denied the request
+	Scope string
+}
+
+func (e *LimitError) Error() string {
+	return "too many requests, " + e.Scope + " limit"
+}
+
+// Is - A LimitError is an ErrTooManyRequests
+func (e *LimitError) Is(target error) bool {
+	return target == ErrTooManyRequests
+}
+
+// LockoutError - A request of a client locked out after
+// failed authentications
+type LockoutError struct {
+	// RetryAfter the time the client is still locked out for
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrLockedOut, e.RetryAfter)
+}
+
+// Is - A LockoutError is an ErrLockedOut
+func (e *LockoutError) Is(target error) bool {
+	return target == ErrLockedOut
+}
+
+// SuspensionError - A request of a secret in the penalty box
+type SuspensionError struct {
+	// RetryAfter the time the secret is still suspended for
+	RetryAfter time.Duration
+}
+
+func (e *SuspensionError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrSuspended, e.RetryAfter)
+}
+
+// Is - A SuspensionError is an ErrSuspended
+func (e *SuspensionError) Is(target error) bool {
+	return target == ErrSuspended
+}
+
+// StateError - A request with a known secret that is not active
+type StateError struct {
+	// State the lifecycle state of the secret
+	State string
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%v, %s", ErrInactiveSecret, e.State)
+}
+
+// Is - A StateError is an ErrInactiveSecret
+func (e *StateError) Is(target error) bool {
+	return target == ErrInactiveSecret
+}
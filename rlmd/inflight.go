@@ -0,0 +1,103 @@
+package rlmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// secretToInFlightKey - make redis key of the sorted set of the
+// requests in flight of a secret, scored by their expiry time
+func secretToInFlightKey(secret string) string {
+	return "user:sec:inflight:" + secret
+}
+
+// Acquire - Registers a request of a secret in flight, if the secret
+// has fewer requests in flight than the maximum. The returned function
+// releases it, and has to be called once the request is answered. The
+// requests not released in time, by a crashed replica, expire.
+// Returns a LimitError, which is an ErrTooManyRequests, if the secret
+// is at its maximum.
+func (s *RateLimiter) Acquire(ctx context.Context, secret string) (release func(), err error) {
+	if s.mif <= 0 {
+		return func() {}, nil
+	}
+	account, err := s.account(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	key := secretToInFlightKey(account)
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	member := hex.EncodeToString(id)
+
+	// over is set when the secret is at its maximum, the denial is
+	// recorded once the transaction is over, retries included
+	var over bool
+	txf := func(tx *redis.Tx) error {
+		now := time.Now()
+		over = false
+		// the requests in flight that did not expire
+		count, err := tx.ZCount(ctx, key, fmt.Sprintf("(%d", now.UnixMilli()), "+inf").Result()
+		if err != nil {
+			s.logger.Warn("getting the requests in flight",
+				zap.String("secret", secret),
+				zap.Error(err))
+			return err
+		}
+		if count >= int64(s.mif) {
+			over = true
+			if !s.shadowed("too many requests in flight",
+				zap.String("secret", secret),
+				zap.Int64("count", count)) {
+				s.logger.Debug("too many requests in flight", zap.String("secret", secret))
+				return &LimitError{Scope: ScopeConcurrency}
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			// Forget the leaked requests
+			p.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprintf("%d", now.UnixMilli()))
+			p.ZAdd(ctx, key, redis.Z{Score: float64(now.Add(s.ift).UnixMilli()), Member: member})
+			p.PExpire(ctx, key, s.ift)
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < s.mxr; i++ {
+		err := s.client.Watch(ctx, txf, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if over {
+			// The penalty box records the denials in shadow mode
+			// too, so that its suspensions are shadowed as well
+			s.penalties.denied(account)
+		}
+		if err == nil {
+			return func() { s.release(account, member) }, nil
+		}
+		return nil, err
+	}
+	return nil, errors.New("transaction maximum retries")
+}
+
+// release - Removes a request from the requests in flight of the
+// secret the counters of a secret are kept under
+func (s *RateLimiter) release(account, member string) {
+	// The request context may be canceled already
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.client.ZRem(ctx, secretToInFlightKey(account), member).Err(); err != nil {
+		s.logger.Warn("releasing a request in flight",
+			zap.String("secret", account),
+			zap.Error(err))
+	}
+}
@@ -0,0 +1,180 @@
+package rlmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// penaltyBoxMax - the maximum number of secrets in the penalty box
+const penaltyBoxMax = 10000
+
+// penaltyMemory - the time after its last suspension the
+// suspensions of a secret stop escalating
+const penaltyMemory = 24 * time.Hour
+
+var (
+	// penaltySuspensions - the number of secrets suspended
+	penaltySuspensions = expvar.NewInt("rlmd_penalty_suspensions")
+	// penaltyRejections - the number of requests of suspended secrets
+	penaltyRejections = expvar.NewInt("rlmd_penalty_rejections")
+)
+
+// secretID - identifies a secret in the logs and the admin endpoints
+// without revealing it, by the first 8 bytes of its SHA-256
+func secretID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Suspension - An account suspended by the penalty box, the
+// secrets sharing its counters are suspended with it
+type Suspension struct {
+	// ID the identifier of the account, see secretID
+	ID    string    `json:"id"`
+	Until time.Time `json:"until"`
+	// Level the number of suspensions of the secret in a row
+	Level int `json:"level"`
+}
+
+// penalty - the denials and the suspension of a secret
+type penalty struct {
+	// denials the number of denials since windowStart
+	denials     int
+	windowStart time.Time
+	level       int
+	until       time.Time
+}
+
+// penaltyBox - The accounts that keep being denied in spite of the
+// Retry-After header, keyed by the secret the counters of their
+// rotated secrets are kept under. They are suspended, and rejected
+// without touching redis. It is kept in memory, each replica has its
+// own, and forgets the accounts whose penalty has no effect anymore.
+type penaltyBox struct {
+	sync.Mutex
+	settings PenaltySettings
+	logger   *zap.Logger
+	secrets  *ttlMap[*penalty]
+}
+
+func newPenaltyBox(settings PenaltySettings, logger *zap.Logger) *penaltyBox {
+	return &penaltyBox{
+		settings: settings,
+		logger:   logger,
+		secrets:  newTTLMap[*penalty](penaltyBoxMax),
+	}
+}
+
+// suspended - returns the time the secret is still suspended for,
+// 0 if it is not.
+func (s *penaltyBox) suspended(secret string) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	p, ok := s.secrets.get(secret, now)
+	if !ok {
+		return 0
+	}
+	return max(p.until.Sub(now), 0)
+}
+
+// expiry - returns the time a penalty has no effect anymore: the
+// secret is not suspended, its denials are out of the window and the
+// escalation of its suspensions is forgotten.
+func (s *penaltyBox) expiry(p *penalty) time.Time {
+	expiry := p.windowStart.Add(s.settings.Window)
+	if !p.until.IsZero() && p.until.Add(penaltyMemory).After(expiry) {
+		expiry = p.until.Add(penaltyMemory)
+	}
+	return expiry
+}
+
+// denied - Records the denial of a request of a secret. After
+// Denials denials within the Window the secret is suspended, for a
+// time doubling with each suspension, up to MaxSuspension. The
+// escalation is forgotten a day after the last suspension.
+func (s *penaltyBox) denied(secret string) {
+	if s.settings.Denials <= 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	p, ok := s.secrets.get(secret, now)
+	if !ok {
+		if s.secrets.full(now) {
+			return
+		}
+		p = &penalty{}
+	}
+	if now.Sub(p.windowStart) > s.settings.Window {
+		p.denials = 0
+		p.windowStart = now
+	}
+	if !p.until.IsZero() && now.Sub(p.until) > penaltyMemory {
+		p.level = 0
+	}
+	p.denials++
+	if p.denials < s.settings.Denials {
+		s.secrets.add(secret, p, s.expiry(p), now)
+		return
+	}
+	suspension := s.settings.Suspension
+	for i := 0; i < p.level && suspension < s.settings.MaxSuspension; i++ {
+		suspension *= 2
+	}
+	suspension = min(suspension, s.settings.MaxSuspension)
+	p.level++
+	p.until = now.Add(suspension)
+	p.denials = 0
+	s.secrets.add(secret, p, s.expiry(p), now)
+	penaltySuspensions.Add(1)
+	s.logger.Warn("suspending secret denied too many times",
+		zap.String("id", secretID(secret)),
+		zap.Int("level", p.level),
+		zap.Duration("suspension", suspension))
+}
+
+// Suspensions - Returns the accounts currently suspended, by ID
+func (s *RateLimiter) Suspensions() []Suspension {
+	s.penalties.Lock()
+	defer s.penalties.Unlock()
+	now := time.Now()
+	var suspensions []Suspension
+	s.penalties.secrets.each(now, func(secret string, p *penalty) {
+		if p.until.After(now) {
+			suspensions = append(suspensions, Suspension{ID: secretID(secret), Until: p.until, Level: p.level})
+		}
+	})
+	slices.SortFunc(suspensions, func(a, b Suspension) int { return strings.Compare(a.ID, b.ID) })
+	return suspensions
+}
+
+// PenaltySettings - The settings of the penalty box
+type PenaltySettings struct {
+	// Denials The number of requests of a secret denied within the
+	// Window after which the secret is suspended, 0 for no penalty box
+	// Configurable through the environment
+	// variable DS_PENALTY_DENIALS, defaults to 0
+	Denials int
+	// Window The window the denials are counted in
+	// Configurable through the environment
+	// variable DS_PENALTY_WINDOW, defaults to 1m
+	Window time.Duration
+	// Suspension The duration of the first suspension of a secret,
+	// it doubles with each suspension in the following day
+	// Configurable through the environment
+	// variable DS_PENALTY_SUSPENSION, defaults to 1m
+	Suspension time.Duration
+	// MaxSuspension The maximum duration of a suspension
+	// Configurable through the environment
+	// variable DS_PENALTY_MAX_SUSPENSION, defaults to 1h
+	MaxSuspension time.Duration
+}
@@ -0,0 +1,88 @@
+package rlmd
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestPenaltyBoxDenied(t *testing.T) {
+	box := newPenaltyBox(PenaltySettings{
+		Denials:       2,
+		Window:        time.Minute,
+		Suspension:    time.Minute,
+		MaxSuspension: 4 * time.Minute,
+	}, zap.NewNop())
+	if d := box.suspended("secret"); d != 0 {
+		t.Fatalf("suspended before any denial = %v, want 0", d)
+	}
+	box.denied("secret")
+	if d := box.suspended("secret"); d != 0 {
+		t.Fatalf("suspended after 1 denial = %v, want 0", d)
+	}
+	// The suspension doubles with each suspension, up to MaxSuspension
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		if i > 0 {
+			box.denied("secret")
+		}
+		box.denied("secret")
+		d := box.suspended("secret")
+		if d > want || d < want-time.Second {
+			t.Errorf("suspension %d = %v, want %v", i+1, d, want)
+		}
+		if p, _ := box.secrets.get("secret", time.Now()); p.level != i+1 {
+			t.Errorf("suspension %d level = %d, want %d", i+1, p.level, i+1)
+		}
+	}
+	if d := box.suspended("other"); d != 0 {
+		t.Errorf("suspended other secret = %v, want 0", d)
+	}
+}
+
+func TestPenaltyBoxReset(t *testing.T) {
+	box := newPenaltyBox(PenaltySettings{
+		Denials:       2,
+		Window:        time.Minute,
+		Suspension:    time.Minute,
+		MaxSuspension: time.Hour,
+	}, zap.NewNop())
+	// Denials out of the window are not counted
+	box.denied("secret")
+	p, _ := box.secrets.get("secret", time.Now())
+	p.windowStart = time.Now().Add(-2 * time.Minute)
+	box.denied("secret")
+	if d := box.suspended("secret"); d != 0 {
+		t.Fatalf("suspended after denials in two windows = %v, want 0", d)
+	}
+	// The escalation is forgotten long after the last suspension
+	p, _ = box.secrets.get("secret", time.Now())
+	p.level = 3
+	p.until = time.Now().Add(-penaltyMemory - time.Minute)
+	box.denied("secret")
+	if d := box.suspended("secret"); d > time.Minute || d < time.Minute-time.Second {
+		t.Errorf("suspension after the escalation is forgotten = %v, want %v", d, time.Minute)
+	}
+	// A penalty is forgotten once it has no effect anymore
+	p, _ = box.secrets.get("secret", time.Now())
+	p.windowStart = time.Now().Add(-2 * time.Minute)
+	p.until = time.Now().Add(-penaltyMemory - time.Minute)
+	if expiry := box.expiry(p); !expiry.Before(time.Now()) {
+		t.Errorf("penalty with no effect expires at %v, in the future", expiry)
+	}
+	box.secrets.add("secret", p, box.expiry(p), time.Now())
+	box.suspended("secret")
+	if len(box.secrets.entries) != 0 {
+		t.Errorf("penalty with no effect is kept")
+	}
+}
+
+func TestPenaltyBoxDisabled(t *testing.T) {
+	box := newPenaltyBox(PenaltySettings{Window: time.Minute, Suspension: time.Minute}, zap.NewNop())
+	for range 10 {
+		box.denied("secret")
+	}
+	if d := box.suspended("secret"); d != 0 {
+		t.Errorf("suspended with no penalty box = %v, want 0", d)
+	}
+}
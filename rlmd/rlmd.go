@@ -4,12 +4,13 @@ package rlmd
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
-	"os"
+	"slices"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -24,6 +25,41 @@ type RateLimiter struct {
 	rps int
 	// Max database retries
 	mxr int
+	// Cost of a "304 Not Modified" response
+	nmc int
+	// shadow mode, the requests that would be denied are allowed
+	shadow bool
+	// Requests per second of all the secrets, 0 for no limit
+	grps int
+	// Requests per second of all the secrets per endpoint
+	erps map[string]int
+	// Maximum number of requests of a secret in flight, 0 for no limit
+	mif int
+	// Time after which a request in flight is considered leaked
+	ift time.Duration
+	// Protection against the enumeration of the secrets
+	auth     AuthSettings
+	negative *negativeCache
+	// The accounts denied too many times
+	penalties *penaltyBox
+	// The accounts of the secrets
+	accounts *accountCache
+}
+
+// shadowDenied - the number of requests the rate limiter would have
+// denied in shadow mode
+var shadowDenied = expvar.NewInt("rlmd_shadow_denied")
+
+// shadowed - returns true if the rate limiter is in shadow mode, in
+// which case the denial is logged and counted instead, and the
+// request is let through.
+func (s *RateLimiter) shadowed(msg string, fields ...zap.Field) bool {
+	if !s.shadow {
+		return false
+	}
+	s.logger.Info("shadow mode, would deny "+msg, fields...)
+	shadowDenied.Add(1)
+	return true
 }
 
 // secretToKey - make redis key of user secret
@@ -37,21 +73,68 @@ func secretToCountKey(secret string) string {
 	return "user:sec:count:" + secret
 }
 
-// CheckSecret validate the secret.
-func (s *RateLimiter) CheckSecret(secret string) (int, error) {
-	val, err := s.client.Get(context.Background(), secretToKey(secret)).Result()
+// countWindow - the reset period of the request counters
+const countWindow = time.Second
+
+// globalCountKey - redis key of the requests counter of all the secrets
+const globalCountKey = "global:count"
+
+// endpointToCountKey - make redis key to identify the requests
+// counter of all the secrets associated with an endpoint
+func endpointToCountKey(endpoint string) string {
+	return "endpoint:count:" + endpoint
+}
+
+// CheckSecret validate the secret, and returns it with its plan and
+// its lifecycle, read in the same round trip as its account, which is
+// cached. A known secret that is not active is answered with a
+// StateError.
+func (s *RateLimiter) CheckSecret(ctx context.Context, secret string) (int, *Secret, error) {
+	var get, plan, link *redis.StringCmd
+	var meta *redis.MapStringStringCmd
+	// The errors are the ones of the commands
+	s.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		get = p.Get(ctx, secretToKey(secret))
+		meta = p.HGetAll(ctx, secretToMetaKey(secret))
+		plan = p.Get(ctx, secretToPlanKey(secret))
+		link = p.Get(ctx, secretToLinkKey(secret))
+		return nil
+	})
+	val, err := get.Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			// The secret is not in the database
-			return http.StatusForbidden, err
+			return http.StatusForbidden, nil, err
 		}
 		// Something else went wrong
-		return http.StatusInternalServerError, err
+		return http.StatusInternalServerError, nil, err
 	}
 	if val != secret {
-		return http.StatusForbidden, errors.New("invalid secret")
+		return http.StatusForbidden, nil, errors.New("invalid secret")
+	}
+	fields, err := meta.Result()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	info, err := lifecycle(secret, fields)
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	// The default plan has no key
+	if info.Plan, err = plan.Result(); err != nil && !errors.Is(err, redis.Nil) {
+		return http.StatusInternalServerError, nil, err
+	}
+	if _, err := s.linked(secret, link); err != nil {
+		return http.StatusInternalServerError, nil, err
 	}
-	return http.StatusOK, nil
+	state, err := secretState(fields, time.Now())
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	if state != StateActive {
+		return http.StatusForbidden, info, &StateError{State: state}
+	}
+	return http.StatusOK, info, nil
 }
 
 // Secret - Extract the secret from the request
@@ -67,69 +150,362 @@ func (s *RateLimiter) Secret(ctx context.Context, req *http.Request) (secret str
 	return secret, nil
 }
 
-// Allow - Check if the rate limiter allows a request
-func (s *RateLimiter) Allow(ctx context.Context, req *http.Request) (status int, secret string, err error) {
-	secret, err = s.Secret(ctx, req)
+// Grant - A request of a secret allowed by the rate limiter, and
+// the units charged for it, so that they can be refunded.
+type Grant struct {
+	// Secret the secret of the request
+	Secret string
+	// Plan the customer plan of the secret, empty for the
+	// default plan
+	Plan string
+	// Account the secret the counters of the secret are kept under,
+	// the first one of its chain of rotations
+	Account string
+	// DeprecatedAt the time the secret was rotated, nil if it was not
+	DeprecatedAt *time.Time
+	// ExpiresAt the time the secret expires at, nil if it does not
+	ExpiresAt *time.Time
+	endpoint  string
+	// charges the units charged for the request, in order
+	charges []charge
+}
+
+// charge - Units charged at once to the request counters of a
+// secret and to the aggregate ones
+type charge struct {
+	units int
+	// windows the end of the reset period of each counter
+	// charged, by key
+	windows map[string]time.Time
+	// denied the scope of the limit that denied the charge, or
+	// would have in shadow mode, "" if none did
+	denied string
+}
+
+// Charged - returns the units charged for the request
+func (s *Grant) Charged() int {
+	units := 0
+	for _, c := range s.charges {
+		units += c.units
+	}
+	return units
+}
+
+// Allow - Check if the rate limiter allows a request costing units,
+// and charge them to the secret and to the aggregate limits. The
+// grant is returned whenever the request has a secret, even when
+// the request is denied, with the plan and the lifecycle of the
+// secret once it is authenticated.
+func (s *RateLimiter) Allow(ctx context.Context, req *http.Request, units int) (status int, grant *Grant, err error) {
+	secret, err := s.Secret(ctx, req)
 	if err != nil {
-		return http.StatusBadRequest, secret, err
+		return http.StatusBadRequest, nil, err
+	}
+	grant = &Grant{Secret: secret, endpoint: req.URL.Path}
+	// The suspended accounts do not touch redis, when
+	// the account of the secret is cached
+	cached, ok := s.accounts.get(secret)
+	if ok {
+		if err := s.suspended(cached); err != nil {
+			return http.StatusTooManyRequests, grant, err
+		}
 	}
-	status, err = s.CheckSecret(secret)
+	status, info, err := s.authenticate(ctx, req, secret)
 	if status != http.StatusOK {
-		return status, secret, err
+		return status, grant, err
+	}
+	grant.Plan = info.Plan
+	grant.DeprecatedAt = info.DeprecatedAt
+	grant.ExpiresAt = info.ExpiresAt
+	account, err := s.account(ctx, secret)
+	if err != nil {
+		return http.StatusInternalServerError, grant, err
+	}
+	grant.Account = account
+	if !ok || account != cached {
+		if err := s.suspended(account); err != nil {
+			return http.StatusTooManyRequests, grant, err
+		}
+	}
+	status, c, err := s.charge(ctx, secret, grant.endpoint, units)
+	s.penalize(account, c.denied)
+	if status == http.StatusOK {
+		grant.charges = append(grant.charges, c)
+	}
+	return status, grant, err
+}
+
+// suspended - Returns a SuspensionError if the account is suspended
+// by the penalty box, nil if it is not
+func (s *RateLimiter) suspended(account string) error {
+	suspension := s.penalties.suspended(account)
+	if suspension > 0 && !s.shadowed("suspended secret",
+		zap.String("id", secretID(account)),
+		zap.Duration("suspension", suspension)) {
+		penaltyRejections.Add(1)
+		return &SuspensionError{RetryAfter: suspension}
+	}
+	return nil
+}
+
+// penalize - Records in the penalty box a request of an account denied
+// by the limit of scope. Only its own limit counts, the aggregate limits
+// are not the fault of the account, the requests in flight are recorded
+// by Acquire. The denials are recorded in shadow mode too, so that the
+// suspensions are shadowed as well.
+func (s *RateLimiter) penalize(account, scope string) {
+	if scope == ScopeSecret {
+		s.penalties.denied(account)
+	}
+}
+
+// Consume - Charge additional units to the current second request
+// count of a request that already passed Allow, and to the aggregate
+// limits of its endpoint. Returns a LimitError, which is an
+// ErrTooManyRequests, if one of them does not have enough units left.
+func (s *RateLimiter) Consume(ctx context.Context, grant *Grant, units int) (int, error) {
+	status, c, err := s.charge(ctx, grant.Secret, grant.endpoint, units)
+	if status == http.StatusOK {
+		grant.charges = append(grant.charges, c)
+	}
+	return status, err
+}
+
+// limit - A requests per second counter charged by a request
+type limit struct {
+	scope string
+	key   string
+	rps   int
+}
+
+// limits - Returns the counters a request of a secret to an endpoint
+// is charged to: the one of the secret, and the aggregate ones of all
+// the secrets and of the endpoint, when they are limited.
+func (s *RateLimiter) limits(secret, endpoint string) []limit {
+	limits := []limit{{scope: ScopeSecret, key: secretToCountKey(secret), rps: s.rps}}
+	if s.grps > 0 {
+		limits = append(limits, limit{scope: ScopeGlobal, key: globalCountKey, rps: s.grps})
+	}
+	if rps, ok := s.erps[endpoint]; ok {
+		limits = append(limits, limit{scope: ScopeEndpoint, key: endpointToCountKey(endpoint), rps: rps})
+	}
+	return limits
+}
+
+// charge - Atomically add units to the current second request counts
+// of a secret and of the aggregate limits, if all of them allow it.
+// A denied request is not charged to any of them, the returned
+// LimitError tells which limit denied it, and so does the charge,
+// also in shadow mode.
+func (s *RateLimiter) charge(ctx context.Context, secret, endpoint string, units int) (status int, c charge, err error) {
+	account, err := s.account(ctx, secret)
+	if err != nil {
+		return http.StatusInternalServerError, c, err
+	}
+	limits := s.limits(account, endpoint)
+	keys := make([]string, len(limits))
+	for i, l := range limits {
+		keys[i] = l.key
 	}
-	key := secretToCountKey(secret)
 
 	txf := func(tx *redis.Tx) error {
-		// getting the current second request count
-		count, err := tx.Get(ctx, key).Int()
-		if err != nil && err != redis.Nil {
-			s.logger.Warn("getting the current second request count",
+		now := time.Now()
+		c = charge{}
+		// getting the current second request counts, and the
+		// time left in their reset periods
+		counts, ttls, err := s.counts(ctx, tx, keys)
+		if err != nil {
+			s.logger.Warn("getting the current second request counts",
 				zap.String("secret", secret),
 				zap.Error(err))
 			return err
 		}
-		if count >= s.rps {
+		for i, l := range limits {
+			if counts[i]+units <= l.rps {
+				continue
+			}
+			if c.denied == "" {
+				c.denied = l.scope
+			}
+			// In shadow mode, count the request as if
+			// it was allowed
+			if s.shadowed("too many requests",
+				zap.String("secret", secret),
+				zap.String("scope", l.scope),
+				zap.Int("count", counts[i]),
+				zap.Int("units", units)) {
+				continue
+			}
 			// Do nor allow requests associated with the
 			// current secret in the current reset period
-			s.logger.Debug("too many requests", zap.String("secret", secret))
+			s.logger.Debug("too many requests",
+				zap.String("secret", secret),
+				zap.String("scope", l.scope))
 
 			status = http.StatusTooManyRequests
-			return ErrTooManyRequests
+			return &LimitError{Scope: l.scope}
 		}
+		windows := make(map[string]time.Time, len(limits))
 		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
-			if count > 0 {
-				// The count was in the database, increment it by one
-				p.Incr(ctx, key)
-			} else {
-				// New bust, insert it in the database
-				p.Set(ctx, key, count+1, time.Second)
+			for i, l := range limits {
+				if ttls[i] > 0 {
+					// The count was in the database, increment it
+					p.IncrBy(ctx, l.key, int64(units))
+					windows[l.key] = now.Add(ttls[i])
+				} else {
+					// New bust, insert it in the database
+					p.Set(ctx, l.key, units, countWindow)
+					windows[l.key] = now.Add(countWindow)
+				}
 			}
 			status = http.StatusOK
 			return nil
 		})
+		c.units = units
+		c.windows = windows
+		return err
+	}
+	for i := 0; i < s.mxr; i++ {
+		err := s.client.Watch(ctx, txf, keys...)
+		if err == nil {
+			return status, c, nil
+		}
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return status, c, err
+	}
+	return http.StatusInternalServerError, c, errors.New("transaction maximum retries")
+}
 
+// counts - Returns the request counts of the counters, 0 for the
+// missing ones, and the time left in their reset periods, not
+// positive for the missing ones.
+func (s *RateLimiter) counts(ctx context.Context, tx *redis.Tx, keys []string) ([]int, []time.Duration, error) {
+	gets := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	// The errors are the ones of the commands
+	tx.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, key := range keys {
+			gets[i] = p.Get(ctx, key)
+			ttls[i] = p.PTTL(ctx, key)
+		}
+		return nil
+	})
+	counts := make([]int, len(keys))
+	durations := make([]time.Duration, len(keys))
+	for i := range keys {
+		count, err := gets[i].Int()
+		if err != nil && err != redis.Nil {
+			return nil, nil, err
+		}
+		counts[i] = count
+		if durations[i], err = ttls[i].Result(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return counts, durations, nil
+}
+
+// NotModified - Lower the cost of a request answered with
+// "304 Not Modified" from the charged units to the configured
+// not modified cost, by refunding the difference.
+func (s *RateLimiter) NotModified(ctx context.Context, grant *Grant) error {
+	charged := grant.Charged()
+	if charged <= s.nmc {
+		return nil
+	}
+	return s.refund(ctx, grant, charged-s.nmc)
+}
+
+// Refund - Give back all the units charged for a request that was
+// not served after all, for instance because its secret has too many
+// requests in flight.
+func (s *RateLimiter) Refund(ctx context.Context, grant *Grant) error {
+	return s.refund(ctx, grant, grant.Charged())
+}
+
+// RefundLast - Give back the units of the latest charge of a request,
+// the one of a page of a paginated request that could not be fetched
+func (s *RateLimiter) RefundLast(ctx context.Context, grant *Grant) error {
+	if len(grant.charges) == 0 {
+		return nil
+	}
+	c := &grant.charges[len(grant.charges)-1]
+	if err := s.refundCharge(ctx, grant.Secret, c, c.units); err != nil {
+		return err
+	}
+	grant.charges = grant.charges[:len(grant.charges)-1]
+	return nil
+}
+
+// refund - Give back units charged for a request, the latest
+// charges first. The units are refunded to every counter they were
+// charged to.
+func (s *RateLimiter) refund(ctx context.Context, grant *Grant, units int) error {
+	for i := len(grant.charges) - 1; i >= 0 && units > 0; i-- {
+		c := &grant.charges[i]
+		refunded := min(units, c.units)
+		if err := s.refundCharge(ctx, grant.Secret, c, refunded); err != nil {
+			return err
+		}
+		c.units -= refunded
+		units -= refunded
+	}
+	return nil
+}
+
+// refundCharge - Atomically give back units of a charge to the
+// counters it was charged to. A count never goes below zero, and
+// nothing is refunded to a counter once the reset period of the
+// charge is over, even if a later request started a new one.
+func (s *RateLimiter) refundCharge(ctx context.Context, secret string, c *charge, units int) error {
+	keys := slices.Collect(maps.Keys(c.windows))
+
+	txf := func(tx *redis.Tx) error {
+		now := time.Now()
+		counts, ttls, err := s.counts(ctx, tx, keys)
+		if err != nil {
+			s.logger.Warn("getting the current second request counts",
+				zap.String("secret", secret),
+				zap.Error(err))
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			for i, key := range keys {
+				// A reset period starting after the one of the
+				// charge ends at least a full period later
+				if ttls[i] <= 0 || now.Add(ttls[i]).After(c.windows[key].Add(countWindow/2)) {
+					continue
+				}
+				p.DecrBy(ctx, key, int64(min(units, counts[i])))
+			}
+			return nil
+		})
 		return err
 	}
 	for i := 0; i < s.mxr; i++ {
-		err := s.client.Watch(ctx, txf, key)
+		err := s.client.Watch(ctx, txf, keys...)
 		if err == nil {
-			return status, secret, nil
+			return nil
 		}
 		if err == redis.TxFailedErr {
 			continue
 		}
-		return status, secret, err
+		return err
 	}
-	return http.StatusInternalServerError, secret, errors.New("transaction maximum retries")
+	return errors.New("transaction maximum retries")
 }
 
-// Info - Get the rate limiting flags associated with a secret to add to a response
+// Info - Get the rate limiting flags associated with a secret to add to a response.
+// The secret is not checked, it is the one of a request that passed Allow.
 func (s *RateLimiter) Info(ctx context.Context, secret string) (map[string]string, error) {
 	m := make(map[string]string)
-	if _, err := s.CheckSecret(secret); err != nil {
+	account, err := s.account(ctx, secret)
+	if err != nil {
 		return m, err
 	}
-	key := secretToCountKey(secret)
+	key := secretToCountKey(account)
 	txf := func(tx *redis.Tx) error {
 		count, err := tx.Get(ctx, key).Int()
 		if err != nil && err != redis.Nil {
@@ -138,7 +514,7 @@ func (s *RateLimiter) Info(ctx context.Context, secret string) (map[string]strin
 				zap.Error(err))
 			return err
 		}
-		remaining := s.mxr - count
+		remaining := max(s.rps-count, 0)
 		duration, err := tx.PTTL(ctx, key).Result()
 		if err != nil && err != redis.Nil {
 			s.logger.Warn("getting milliseconds to reset ",
@@ -180,12 +556,7 @@ func (s *RateLimiter) Close() {
 // New - Create a new Downstream rate limiter
 func New(settings *Settings, logger *zap.Logger) (*RateLimiter, error) {
 	// Create the redis client
-	client := redis.NewClient(&redis.Options{
-		Addr:     settings.RedisHost + ":" + settings.RedisPort,
-		Username: settings.RedisUser,
-		Password: settings.RedisPassword,
-		DB:       settings.RedisDB,
-	})
+	client := redis.NewClient(settings.RedisOptions())
 	// Check if the database is up
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*2))
 	defer cancel()
@@ -193,27 +564,32 @@ func New(settings *Settings, logger *zap.Logger) (*RateLimiter, error) {
 		return nil, err
 	}
 	// Read the secrets from a file
-	data, err := os.ReadFile(settings.SecretsFile)
-	if err != nil {
-		log.Fatal("while opening secrets file: ", err)
-	}
-	var secrets []string
-	err = json.Unmarshal(data, &secrets)
+	secrets, err := readSecrets(settings.SecretsFile)
 	if err != nil {
-		log.Fatal("json Unmarshal secrets data: ", err)
+		log.Fatal("while reading secrets file: ", err)
 	}
 	// Add the secrets to the redis database
 	for _, secret := range secrets {
-		err := client.Set(context.Background(), secretToKey(secret), secret, 0).Err()
+		err := storeSecret(context.Background(), client, secret)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 	return &RateLimiter{
-		client: client,
-		logger: logger,
-		rps:    settings.RequestsPerSecond,
-		mxr:    settings.RedisMaxRetries,
+		client:    client,
+		logger:    logger,
+		rps:       settings.RequestsPerSecond,
+		mxr:       settings.RedisMaxRetries,
+		nmc:       settings.NotModifiedCost,
+		shadow:    settings.ShadowMode,
+		grps:      settings.GlobalRequestsPerSecond,
+		erps:      settings.EndpointRequestsPerSecond,
+		mif:       settings.MaxInFlight,
+		ift:       settings.InFlightTTL,
+		auth:      settings.Auth,
+		negative:  newNegativeCache(settings.Auth.NegativeCacheTTL),
+		penalties: newPenaltyBox(settings.Penalty, logger),
+		accounts:  newAccountCache(),
 	}, nil
 }
 
@@ -244,7 +620,8 @@ type Settings struct {
 	// variable REDIS_MAX_RETRIES, defaults to 5
 	RedisMaxRetries int
 	// The source of secrets. We use a json file
-	// that that parses to s slice of strings.
+	// that that parses to s slice of strings, or of
+	// objects with a "secret" and a "plan".
 	// Configurable through the environment
 	// variable USERS_SECRETS_FILE, defaults to "./secrets.json"
 	// and can be recreated with the script in scripts/gen-secrets.sh
@@ -253,4 +630,50 @@ type Settings struct {
 	// Configurable through the environment
 	// variable DS_REQUESTS_PER_SECOND, defaults to 5
 	RequestsPerSecond int
+	// The number of units a request answered with
+	// "304 Not Modified" costs, instead of a full request.
+	// Configurable through the environment
+	// variable DS_NOT_MODIFIED_COST, defaults to 0
+	NotModifiedCost int
+	// ShadowMode The requests over a limit, in flight over the maximum,
+	// of a locked out client or of a suspended secret are logged and
+	// counted in the rlmd_shadow_denied metric, but allowed
+	// Configurable through the environment
+	// variable DS_SHADOW_MODE, defaults to false
+	ShadowMode bool
+	// Requests per second of all the secrets together, a cap
+	// protecting the Atlas quota, 0 for no limit
+	// Configurable through the environment
+	// variable DS_GLOBAL_REQUESTS_PER_SECOND, defaults to 0
+	GlobalRequestsPerSecond int
+	// Requests per second of all the secrets together per endpoint,
+	// the endpoints not listed are not limited
+	// Configurable through the environment variable
+	// DS_ENDPOINT_REQUESTS_PER_SECOND, for instance "/series/live:20"
+	EndpointRequestsPerSecond map[string]int
+	// The maximum number of requests of a secret in flight at
+	// the same time, across all the replicas, 0 for no limit
+	// Configurable through the environment
+	// variable DS_MAX_IN_FLIGHT, defaults to 0
+	MaxInFlight int
+	// The time after which a request in flight is not counted anymore,
+	// should its replica crash before releasing it. It should be longer
+	// than the longest request.
+	// Configurable through the environment
+	// variable DS_IN_FLIGHT_TTL, defaults to 1m
+	InFlightTTL time.Duration
+	// Auth The protection against the enumeration of the secrets
+	Auth AuthSettings
+	// Penalty The suspension of the secrets denied too many times
+	Penalty PenaltySettings
+}
+
+// RedisOptions - Returns the options of a client of the redis database
+func (s *Settings) RedisOptions() *redis.Options {
+	return &redis.Options{
+		Addr:     s.RedisHost + ":" + s.RedisPort,
+		Username: s.RedisUser,
+		Password: s.RedisPassword,
+		DB:       s.RedisDB,
+	}
 }
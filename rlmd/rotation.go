@@ -0,0 +1,188 @@
+package rlmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// secretToLinkKey - make redis key of the secret a rotated secret
+// shares its counters with
+func secretToLinkKey(secret string) string {
+	return "user:sec:link:" + secret
+}
+
+// accountCacheMax - the maximum number of secrets in
+// the account cache
+const accountCacheMax = 10000
+
+// accountCacheTTL - the time the account of a secret is cached for
+const accountCacheTTL = 10 * time.Minute
+
+// accountCache - The secrets the counters of the secrets are kept
+// under. A link is set when a secret is created by a rotation and
+// never changes, the TTL only bounds the memory of the secrets that
+// are not used anymore.
+type accountCache struct {
+	sync.Mutex
+	accounts *ttlMap[string]
+}
+
+func newAccountCache() *accountCache {
+	return &accountCache{accounts: newTTLMap[string](accountCacheMax)}
+}
+
+// get - returns the account of a secret, and false if it
+// is not cached
+func (s *accountCache) get(secret string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	return s.accounts.get(secret, time.Now())
+}
+
+// add - records the account of a secret
+func (s *accountCache) add(secret, account string) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.accounts.add(secret, account, now.Add(accountCacheTTL), now)
+}
+
+// linked - Returns the account of a secret from the result of the
+// GET of its link, and caches it
+func (s *RateLimiter) linked(secret string, link *redis.StringCmd) (string, error) {
+	account, err := link.Result()
+	if errors.Is(err, redis.Nil) {
+		account = secret
+	} else if err != nil {
+		return "", err
+	}
+	s.accounts.add(secret, account)
+	return account, nil
+}
+
+// account - Returns the secret the counters of a secret are kept
+// under: the first secret of its chain of rotations.
+func (s *RateLimiter) account(ctx context.Context, secret string) (string, error) {
+	if account, ok := s.accounts.get(secret); ok {
+		return account, nil
+	}
+	return s.linked(secret, s.client.Get(ctx, secretToLinkKey(secret)))
+}
+
+// lifecycle - Returns the lifecycle of a secret from the fields
+// of its lifecycle hash. Its expiry is the earliest of the one of the
+// secrets file and of the sunset of a rotation.
+func lifecycle(secret string, fields map[string]string) (*Secret, error) {
+	res := &Secret{Secret: secret, State: fields["state"]}
+	var sunsetAt *time.Time
+	for name, t := range map[string]**time.Time{
+		"not_before":    &res.NotBefore,
+		"expires_at":    &res.ExpiresAt,
+		"deprecated_at": &res.DeprecatedAt,
+		"sunset_at":     &sunsetAt,
+	} {
+		str, ok := fields[name]
+		if !ok {
+			continue
+		}
+		val, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return nil, err
+		}
+		*t = &val
+	}
+	if sunsetAt != nil && (res.ExpiresAt == nil || sunsetAt.Before(*res.ExpiresAt)) {
+		res.ExpiresAt = sunsetAt
+	}
+	return res, nil
+}
+
+// newSecret - Generates a random secret
+func newSecret() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Rotate - Issues a new secret replacing an active one. The new secret
+// has the plan of the old one and shares its rate limiting counters.
+// The old secret is deprecated, and keeps working for the grace period
+// before its sunset, unless it expires sooner. The rotation has fields
+// of its own in the lifecycle hash, the expiry of the secrets file is
+// left alone. Returns the new secret and the expiry time of the old
+// one, or ErrRotated if the secret was already rotated.
+func (s *RateLimiter) Rotate(ctx context.Context, secret string, grace time.Duration) (rotated string, expiresAt time.Time, err error) {
+	status, info, err := s.CheckSecret(ctx, secret)
+	if status == http.StatusForbidden && !errors.Is(err, ErrInactiveSecret) {
+		return "", expiresAt, fmt.Errorf("%w: %v", ErrInvalidSecret, err)
+	}
+	if err != nil {
+		return "", expiresAt, err
+	}
+	if status != http.StatusOK {
+		return "", expiresAt, fmt.Errorf("checking secret, status %d", status)
+	}
+	account, err := s.account(ctx, secret)
+	if err != nil {
+		return "", expiresAt, err
+	}
+	rotated, err = newSecret()
+	if err != nil {
+		return "", expiresAt, err
+	}
+	metaKey := secretToMetaKey(secret)
+
+	txf := func(tx *redis.Tx) error {
+		fields, err := tx.HGetAll(ctx, metaKey).Result()
+		if err != nil {
+			return err
+		}
+		current, err := lifecycle(secret, fields)
+		if err != nil {
+			return err
+		}
+		if current.DeprecatedAt != nil {
+			return ErrRotated
+		}
+		now := time.Now()
+		sunsetAt := now.Add(grace)
+		expiresAt = sunsetAt
+		if current.ExpiresAt != nil && current.ExpiresAt.Before(expiresAt) {
+			expiresAt = *current.ExpiresAt
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.Set(ctx, secretToKey(rotated), rotated, 0)
+			if info.Plan != "" {
+				p.Set(ctx, secretToPlanKey(rotated), info.Plan, 0)
+			}
+			p.Set(ctx, secretToLinkKey(rotated), account, 0)
+			p.HSet(ctx, metaKey, map[string]any{
+				"deprecated_at": now.Format(time.RFC3339Nano),
+				"sunset_at":     sunsetAt.Format(time.RFC3339Nano),
+			})
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < s.mxr; i++ {
+		err := s.client.Watch(ctx, txf, metaKey)
+		if err == nil {
+			return rotated, expiresAt, nil
+		}
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return "", expiresAt, err
+	}
+	return "", expiresAt, errors.New("transaction maximum retries")
+}
@@ -0,0 +1,163 @@
+package rlmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The lifecycle states of a secret
+const (
+	// StateActive the secret can be used
+	StateActive = "active"
+	// StateSuspended the secret is temporarily disabled
+	StateSuspended = "suspended"
+	// StateRevoked the secret is permanently disabled
+	StateRevoked = "revoked"
+	// StateExpired the secret reached its expiry time
+	StateExpired = "expired"
+	// StatePending the secret did not reach its not-before time.
+	// It is never stored, it is derived from NotBefore.
+	StatePending = "pending"
+)
+
+// Secret - An entry of the secrets file. An entry is either the
+// secret string or an object with the secret, its plan and its
+// lifecycle.
+type Secret struct {
+	Secret string `json:"secret"`
+	// Plan the customer plan of the secret, empty for the
+	// default plan
+	Plan string `json:"plan,omitempty"`
+	// State the lifecycle state of the secret, empty for active
+	State string `json:"state,omitempty"`
+	// NotBefore the time the secret can be used from, if not nil
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	// ExpiresAt the time the secret expires at, if not nil. Read
+	// from the database, it is the earliest of the expiry of the
+	// secrets file and of the end of the grace period of a rotation.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// DeprecatedAt the time the secret was rotated, if not nil. It is
+	// set by a rotation, and ignored in the secrets file.
+	DeprecatedAt *time.Time `json:"deprecated_at,omitempty"`
+}
+
+// UnmarshalJSON - accepts both forms of a secrets file entry
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &s.Secret); err == nil {
+		return nil
+	}
+	type secret Secret
+	return json.Unmarshal(data, (*secret)(s))
+}
+
+// secretToPlanKey - make redis key of the plan of a user secret
+func secretToPlanKey(secret string) string {
+	return "user:sec:plan:" + secret
+}
+
+// secretToMetaKey - make redis key of the hash of the lifecycle
+// of a user secret
+func secretToMetaKey(secret string) string {
+	return "user:sec:meta:" + secret
+}
+
+// readSecrets - Read the secrets from a file
+func readSecrets(file string) ([]Secret, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var secrets []Secret
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, err
+	}
+	for _, secret := range secrets {
+		switch secret.State {
+		case "", StateActive, StateSuspended, StateRevoked, StateExpired:
+		default:
+			return nil, fmt.Errorf("secret state %q is not %q, %q, %q or %q",
+				secret.State, StateActive, StateSuspended, StateRevoked, StateExpired)
+		}
+	}
+	return secrets, nil
+}
+
+// storeSecret - Add a secret, its plan and its lifecycle to the
+// redis database. The secrets file owns the state and the validity
+// times of the secret, the ones missing from the entry are removed
+// from the database. The fields set by a rotation are kept.
+func storeSecret(ctx context.Context, client *redis.Client, secret Secret) error {
+	metaKey := secretToMetaKey(secret.Secret)
+	fields := map[string]any{}
+	var missing []string
+	if secret.State != "" {
+		fields["state"] = secret.State
+	} else {
+		missing = append(missing, "state")
+	}
+	for name, t := range map[string]*time.Time{
+		"not_before": secret.NotBefore,
+		"expires_at": secret.ExpiresAt,
+	} {
+		if t != nil {
+			fields[name] = t.Format(time.RFC3339Nano)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	_, err := client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, secretToKey(secret.Secret), secret.Secret, 0)
+		if len(fields) > 0 {
+			p.HSet(ctx, metaKey, fields)
+		}
+		if len(missing) > 0 {
+			p.HDel(ctx, metaKey, missing...)
+		}
+		if secret.Plan == "" {
+			p.Del(ctx, secretToPlanKey(secret.Secret))
+		} else {
+			p.Set(ctx, secretToPlanKey(secret.Secret), secret.Plan, 0)
+		}
+		return nil
+	})
+	return err
+}
+
+// secretState - Returns the lifecycle state of a secret at the time
+// now, from the fields of its lifecycle hash
+func secretState(meta map[string]string, now time.Time) (string, error) {
+	switch meta["state"] {
+	case StateSuspended, StateRevoked, StateExpired:
+		return meta["state"], nil
+	}
+	// The secret expires at the expiry of the secrets file, or
+	// at the sunset of a rotation, whichever comes first
+	for _, name := range []string{"expires_at", "sunset_at"} {
+		str, ok := meta[name]
+		if !ok {
+			continue
+		}
+		expiresAt, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return "", err
+		}
+		if !now.Before(expiresAt) {
+			return StateExpired, nil
+		}
+	}
+	if str, ok := meta["not_before"]; ok {
+		notBefore, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return "", err
+		}
+		if now.Before(notBefore) {
+			return StatePending, nil
+		}
+	}
+	return StateActive, nil
+}
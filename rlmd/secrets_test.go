@@ -0,0 +1,46 @@
+package rlmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSecretState(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	before := now.Add(-time.Minute).Format(time.RFC3339Nano)
+	after := now.Add(time.Minute).Format(time.RFC3339Nano)
+	tests := []struct {
+		name string
+		meta map[string]string
+		want string
+		err  bool
+	}{
+		{name: "no lifecycle", meta: map[string]string{}, want: StateActive},
+		{name: "active", meta: map[string]string{"state": StateActive}, want: StateActive},
+		{name: "suspended", meta: map[string]string{"state": StateSuspended}, want: StateSuspended},
+		{name: "revoked", meta: map[string]string{"state": StateRevoked}, want: StateRevoked},
+		{name: "expired state", meta: map[string]string{"state": StateExpired}, want: StateExpired},
+		{name: "revoked before expiry", meta: map[string]string{"state": StateRevoked, "expires_at": before}, want: StateRevoked},
+		{name: "not expired yet", meta: map[string]string{"expires_at": after}, want: StateActive},
+		{name: "expired", meta: map[string]string{"expires_at": before}, want: StateExpired},
+		{name: "expires now", meta: map[string]string{"expires_at": now.Format(time.RFC3339Nano)}, want: StateExpired},
+		{name: "sunset", meta: map[string]string{"expires_at": after, "sunset_at": before}, want: StateExpired},
+		{name: "before sunset", meta: map[string]string{"sunset_at": after}, want: StateActive},
+		{name: "pending", meta: map[string]string{"not_before": after}, want: StatePending},
+		{name: "started", meta: map[string]string{"not_before": before}, want: StateActive},
+		{name: "expired before start", meta: map[string]string{"not_before": after, "expires_at": before}, want: StateExpired},
+		{name: "bad expires_at", meta: map[string]string{"expires_at": "tomorrow"}, err: true},
+		{name: "bad sunset_at", meta: map[string]string{"sunset_at": "tomorrow"}, err: true},
+		{name: "bad not_before", meta: map[string]string{"not_before": "yesterday"}, err: true},
+	}
+	for _, tt := range tests {
+		got, err := secretState(tt.meta, now)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: state = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package rlmd
+
+import "time"
+
+// ttlMap - A map of entries that expire, bounded in size, so that the
+// memory of a replica does not grow with the secrets it sees. When it
+// is full, the expired entries are evicted, and a new entry is not
+// added if none is. It is not safe for concurrent use, the lock of its
+// owner protects it.
+type ttlMap[V any] struct {
+	max     int
+	entries map[string]ttlEntry[V]
+}
+
+// ttlEntry - a value of a ttlMap and the time it expires
+type ttlEntry[V any] struct {
+	value  V
+	expiry time.Time
+}
+
+func newTTLMap[V any](max int) *ttlMap[V] {
+	return &ttlMap[V]{max: max, entries: make(map[string]ttlEntry[V])}
+}
+
+// get - returns the value of a key, and false if it is missing or
+// expired at the time now
+func (s *ttlMap[V]) get(key string, now time.Time) (V, bool) {
+	entry, ok := s.entries[key]
+	if ok && now.After(entry.expiry) {
+		delete(s.entries, key)
+		ok = false
+	}
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// full - evicts the expired entries when the map is full, and
+// returns true if it still is
+func (s *ttlMap[V]) full(now time.Time) bool {
+	if len(s.entries) < s.max {
+		return false
+	}
+	for key, entry := range s.entries {
+		if now.After(entry.expiry) {
+			delete(s.entries, key)
+		}
+	}
+	return len(s.entries) >= s.max
+}
+
+// add - sets the value of a key until expiry. Returns false if the
+// key is new and the map is full.
+func (s *ttlMap[V]) add(key string, value V, expiry, now time.Time) bool {
+	if _, ok := s.entries[key]; !ok && s.full(now) {
+		return false
+	}
+	s.entries[key] = ttlEntry[V]{value: value, expiry: expiry}
+	return true
+}
+
+// each - calls f with the entries that are not expired at the
+// time now, in no particular order
+func (s *ttlMap[V]) each(now time.Time, f func(key string, value V)) {
+	for key, entry := range s.entries {
+		if !now.After(entry.expiry) {
+			f(key, entry.value)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package rlmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLMap(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := newTTLMap[string](2)
+	if !m.add("a", "1", now.Add(time.Minute), now) || !m.add("b", "2", now.Add(time.Hour), now) {
+		t.Fatal("entry not added to a map with room")
+	}
+	if v, ok := m.get("a", now); !ok || v != "1" {
+		t.Fatalf("get a = %q, %v, want \"1\", true", v, ok)
+	}
+	// A full map does not take new keys, but updates the ones it has
+	if m.add("c", "3", now.Add(time.Hour), now) {
+		t.Fatal("entry added to a full map")
+	}
+	if !m.add("a", "4", now.Add(time.Minute), now) {
+		t.Fatal("entry of a full map not updated")
+	}
+	// The expired entries are evicted to make room
+	later := now.Add(2 * time.Minute)
+	if _, ok := m.get("a", later); ok {
+		t.Fatal("expired entry returned")
+	}
+	m.add("a", "1", now.Add(time.Minute), now)
+	if !m.add("c", "3", later.Add(time.Hour), later) {
+		t.Fatal("entry not added in place of an expired one")
+	}
+	var keys []string
+	m.each(later, func(key, _ string) { keys = append(keys, key) })
+	if len(keys) != 2 {
+		t.Fatalf("entries = %q, want b and c", keys)
+	}
+}
@@ -0,0 +1,52 @@
+package rlmu
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Observe - Feeds the outcome of a request sent to Atlas to the
+// adaptive mode. While Atlas does not publish its limits, the burst
+// limit increases by one slot each time as many requests as the limit
+// succeeded, and is multiplied by the AdaptiveDecrease factor on a
+// 429, a server error or a response slower than AdaptiveLatency. The
+// limit decreases at most once per burst, the outcomes of the requests
+// sent before a decrease being of the same congestion.
+func (s *RateLimiter) Observe(status int, latency time.Duration) {
+	if !s.settings.Adaptive {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.learned {
+		// Atlas publishes its limits
+		return
+	}
+	limit := s.burst.Limit()
+	congested := status == http.StatusTooManyRequests || status >= http.StatusInternalServerError ||
+		latency > s.settings.AdaptiveLatency
+	switch {
+	case congested && s.decreased != s.burst:
+		limit = max(int(float64(limit)*s.settings.AdaptiveDecrease), 1)
+		s.decreased = s.burst
+		s.successes = 0
+	case congested:
+		return
+	default:
+		s.successes++
+		if s.successes < limit || limit >= s.settings.AdaptiveMaxLimit {
+			return
+		}
+		limit++
+		s.successes = 0
+	}
+	s.logger.Debug("adaptive burst limit",
+		zap.Int("status", status),
+		zap.Duration("latency", latency),
+		zap.Int("limit", limit))
+	s.burst.SetLimit(limit)
+	s.changed()
+	s.dispatch()
+}
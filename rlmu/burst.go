@@ -7,62 +7,144 @@ import (
 	"go.uber.org/zap"
 )
 
+// resetTolerance - the difference between the reset times of two
+// responses under which they are considered in the same reset period.
+// It absorbs the network latency jitter.
+const resetTolerance = 100 * time.Millisecond
+
 // Represents a sequence of
 type Burst struct {
 	sync.Mutex
-	limit             int
-	nextReset         time.Time
-	nextRetry         time.Time
-	infoCount         int
+	limit     int
+	nextReset time.Time
+	nextRetry time.Time
+	// estimated is set while nextReset is not the one reported
+	// by Atlas, but an estimation from the previous bursts.
+	estimated         bool
 	slots             int
+	clock             Clock
 	logger            *zap.Logger
 	resetMilliseconds int // Just for logging
 }
 
-func (s *Burst) Slot() bool {
+// Slot - takes n slots of the burst, if there are as many left
+func (s *Burst) Slot(n int) bool {
 	s.Lock()
 	defer s.Unlock()
 	if !s.nextRetry.IsZero() {
 		// We are in "Retry-After" situation
 		return false
 	}
-	if s.slots < s.limit {
-		s.slots++
+	if s.slots+n <= s.limit {
+		s.slots += n
 		return true
 	}
 	return false
 }
 
+// Release - gives back n slots of the burst
+func (s *Burst) Release(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.slots = max(s.slots-n, 0)
+}
+
+// Limit - returns the maximum number of slots of the burst
+func (s *Burst) Limit() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.limit
+}
+
+// SetLimit - changes the maximum number of slots of the burst
+func (s *Burst) SetLimit(limit int) {
+	s.Lock()
+	defer s.Unlock()
+	s.limit = limit
+}
+
+// Available - returns the number of slots left in the burst
+func (s *Burst) Available() int {
+	s.Lock()
+	defer s.Unlock()
+	if !s.nextRetry.IsZero() {
+		// We are in "Retry-After" situation
+		return 0
+	}
+	return max(s.limit-s.slots, 0)
+}
+
+// Rolled - returns true if the response information belongs to an
+// Atlas reset period that starts after the end of the burst.
+func (s *Burst) Rolled(info *Info) bool {
+	s.Lock()
+	defer s.Unlock()
+	if !info.hasReset || s.nextReset.IsZero() || s.estimated {
+		return false
+	}
+	nextReset := s.clock.Now().Add(time.Duration(info.reset * int(time.Millisecond)))
+	return nextReset.After(s.nextReset.Add(resetTolerance))
+}
+
+// Update - Reconciles the burst with the view Atlas has of it. The
+// limit and the reset time are the ones of Atlas. The slots are never
+// fewer than the ones Atlas counted, as another consumer of the Atlas
+// key may have used some, so that no slot is granted that Atlas would
+// reject.
 func (s *Burst) Update(info *Info) {
 	s.Lock()
 	defer s.Unlock()
-	// Increment info count
-	s.infoCount++
 	// Update the limit. Can it change in the fly? Assuming it can.
-	s.limit = info.limit
+	if info.hasLimit {
+		s.limit = info.limit
+	}
+	if info.hasRemaining {
+		// The slots used according to Atlas
+		used := min(s.limit-info.remaining, s.limit)
+		if used > s.slots {
+			s.logger.Debug("reconciling burst slots with atlas",
+				zap.Int("slots", s.slots),
+				zap.Int("atlas", used))
+			s.slots = used
+		}
+	}
 	if info.retryAfter > 0 {
 		// We got a "Retry-After" header
-		retryTime := time.Now().Add(time.Duration(info.retryAfter * int(time.Second)))
+		retryTime := s.clock.Now().Add(time.Duration(info.retryAfter * int(time.Second)))
 		if retryTime.After(s.nextRetry) {
 			s.nextRetry = retryTime
 		}
 	}
-	//X-RateLimit-Reset is always present in the headers
-	nextReset := time.Now().Add(time.Duration(info.reset * int(time.Millisecond)))
-	if nextReset.After(s.nextReset) {
+	// Follow the reset time of Atlas, a response from a later
+	// reset period starts a new burst before it gets here.
+	if info.hasReset {
 		s.resetMilliseconds = info.reset
-		s.nextReset = nextReset
+		s.nextReset = s.clock.Now().Add(time.Duration(info.reset * int(time.Millisecond)))
+		s.estimated = false
 	}
 }
 
+// Deadline - returns the time the burst is over. In a "Retry-After"
+// situation it is the retry time.
+func (s *Burst) Deadline() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	if !s.nextRetry.IsZero() {
+		return s.nextRetry
+	}
+	return s.nextReset
+}
+
 // Reset - returns true if it is time to reset.
 func (s *Burst) Reset() bool {
 	s.Lock()
 	defer s.Unlock()
-	if !s.nextRetry.IsZero() && time.Now().After(s.nextRetry) {
-		return true
+	now := s.clock.Now()
+	if !s.nextRetry.IsZero() {
+		// The "Retry-After" lockout outlasts the reset period
+		return !now.Before(s.nextRetry)
 	}
-	if !s.nextReset.IsZero() && s.nextReset.Before(time.Now()) && s.infoCount >= s.limit {
+	if !s.nextReset.IsZero() && !now.Before(s.nextReset) {
 		s.logger.Debug("Reset here")
 		return true
 	}
@@ -0,0 +1,149 @@
+package rlmu_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yambabmay/yyabws/server/rlmu"
+)
+
+func TestBurstFallbackLimit(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 3
+	rl, _ := newLimiter(t, settings)
+	reserve(t, rl, 3)
+	if r := rl.TryReserve(rlmu.Ticket{}); r != nil {
+		t.Fatal("slot granted past the fallback limit")
+	}
+}
+
+func TestBurstQueueMaxLearned(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 3
+	rl, _ := newLimiter(t, settings)
+	if got := rl.Snapshot().QueueMax; got != 30 {
+		t.Fatalf("queue max = %d before the limit is learned, want 30", got)
+	}
+	rl.Update(header(5, 5, 1000))
+	if got := rl.Snapshot().QueueMax; got != 50 {
+		t.Fatalf("queue max = %d once the limit is learned, want 50", got)
+	}
+	// Only the first limit of Atlas sizes the queue
+	rl.Update(header(8, 8, 1000))
+	if got := rl.Snapshot().QueueMax; got != 50 {
+		t.Fatalf("queue max = %d after the limit changed, want 50", got)
+	}
+}
+
+func TestBurstResetsAtDeadline(t *testing.T) {
+	rl, clock := newLimiter(t, rlmu.DefaultSettings())
+	rl.Update(header(2, 2, 1000))
+	reserve(t, rl, 2)
+	clock.Advance(999 * time.Millisecond)
+	if got := rl.Available(); got != 0 {
+		t.Fatalf("available = %d before the reset, want 0", got)
+	}
+	clock.Advance(time.Millisecond)
+	if got := rl.Available(); got != 2 {
+		t.Fatalf("available = %d after the reset, want 2", got)
+	}
+}
+
+func TestBurstEstimatedReset(t *testing.T) {
+	rl, clock := newLimiter(t, rlmu.DefaultSettings())
+	rl.Update(header(2, 2, 1000))
+	clock.Advance(time.Second)
+	// Without a response from Atlas, the new burst is assumed to
+	// last as long as the previous one
+	if !rl.Snapshot().Estimated {
+		t.Fatal("reset of the new burst not estimated")
+	}
+	reserve(t, rl, 2)
+	clock.Advance(time.Second)
+	if got := rl.Available(); got != 2 {
+		t.Fatalf("available = %d after the estimated reset, want 2", got)
+	}
+}
+
+func TestBurstReconcilesRemaining(t *testing.T) {
+	rl, _ := newLimiter(t, rlmu.DefaultSettings())
+	// Another consumer of the Atlas key used 4 slots
+	rl.Update(header(5, 1, 1000))
+	if got := rl.Available(); got != 1 {
+		t.Fatalf("available = %d, want 1", got)
+	}
+	// Atlas never gives back the slots used here
+	reserve(t, rl, 1)
+	rl.Update(header(5, 3, 1000))
+	if got := rl.Available(); got != 0 {
+		t.Fatalf("available = %d, want 0", got)
+	}
+}
+
+func TestBurstRolled(t *testing.T) {
+	rl, clock := newLimiter(t, rlmu.DefaultSettings())
+	rl.Update(header(2, 2, 1000))
+	reserve(t, rl, 2)
+	clock.Advance(500 * time.Millisecond)
+	// A response from a reset period ending after the burst
+	rl.Update(header(2, 2, 1000))
+	if got := rl.Available(); got != 2 {
+		t.Fatalf("available = %d in the new period, want 2", got)
+	}
+}
+
+func TestReservationRelease(t *testing.T) {
+	rl, _ := newLimiter(t, rlmu.DefaultSettings())
+	rl.Update(header(2, 2, 1000))
+	r := rl.TryReserve(rlmu.Ticket{})
+	r.Release()
+	if got := rl.Available(); got != 2 {
+		t.Fatalf("available = %d after the release, want 2", got)
+	}
+	// A committed slot is not given back
+	r = rl.TryReserve(rlmu.Ticket{})
+	r.Commit()
+	r.Release()
+	if got := rl.Available(); got != 1 {
+		t.Fatalf("available = %d after a committed release, want 1", got)
+	}
+}
+
+func TestReservationReleaseAfterReset(t *testing.T) {
+	rl, clock := newLimiter(t, rlmu.DefaultSettings())
+	rl.Update(header(2, 2, 1000))
+	r := rl.TryReserve(rlmu.Ticket{})
+	clock.Advance(time.Second)
+	reserve(t, rl, 1)
+	// The slot of a burst over does not go to the new one
+	r.Release()
+	if got := rl.Available(); got != 1 {
+		t.Fatalf("available = %d, want 1", got)
+	}
+}
+
+func TestBurstTicketSlots(t *testing.T) {
+	rl, _ := newLimiter(t, rlmu.DefaultSettings())
+	rl.Update(header(5, 5, 1000))
+	r := rl.TryReserve(rlmu.Ticket{Slots: 3})
+	if r == nil {
+		t.Fatal("3 slots not granted")
+	}
+	if got := rl.Available(); got != 2 {
+		t.Fatalf("available = %d, want 2", got)
+	}
+	if r := rl.TryReserve(rlmu.Ticket{Slots: 3}); r != nil {
+		t.Fatal("3 slots granted with 2 left")
+	}
+	r.Release()
+	if got := rl.Available(); got != 5 {
+		t.Fatalf("available = %d after the release, want 5", got)
+	}
+	// A ticket never needs more slots than the limit
+	if r := rl.TryReserve(rlmu.Ticket{Slots: 10}); r == nil {
+		t.Fatal("slots over the limit not granted")
+	}
+	if got := rl.Available(); got != 0 {
+		t.Fatalf("available = %d, want 0", got)
+	}
+}
@@ -0,0 +1,56 @@
+package rlmu
+
+import "time"
+
+// Clock - The source of time of the rate limiter. The system clock is
+// used in production, a virtual one replays Atlas responses without
+// real sleeps, see the sim package.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after the duration d
+	AfterFunc(d time.Duration, f func()) Timer
+	// NewTicker returns a ticker sending the time every period d
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer - A timer created by a Clock
+type Timer interface {
+	// Stop prevents the timer from firing, returns false
+	// if it already fired or was stopped
+	Stop() bool
+}
+
+// Ticker - A ticker created by a Clock
+type Ticker interface {
+	// C returns the channel the ticks are sent on
+	C() <-chan time.Time
+	// Stop turns the ticker off
+	Stop()
+}
+
+// SystemClock - The Clock of the time package
+type SystemClock struct{}
+
+// Now - returns time.Now()
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// AfterFunc - wraps time.AfterFunc
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// NewTicker - wraps time.NewTicker
+func (SystemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (s systemTicker) C() <-chan time.Time {
+	return s.Ticker.C
+}
@@ -6,4 +6,5 @@ var (
 	ErrTooManyWaiting   = errors.New("too many waiting")
 	ErrNoSlotsAvailable = errors.New("no slots available")
 	ErrClosingDown      = errors.New("system closing down")
+	ErrInvalidSettings  = errors.New("invalid upstream rate limiter settings")
 )
@@ -0,0 +1,65 @@
+package rlmu
+
+import (
+	"sync"
+	"time"
+)
+
+// Pending - A slot request waiting in the slot queue, returned by
+// Queue. It is granted a slot or times out without anyone waiting
+// for it, Wait returns the outcome.
+type Pending struct {
+	rl *RateLimiter
+	w  *waiter
+	// timer removes the waiter from the queue after MaxWait
+	timer Timer
+	once  sync.Once
+	r     *Reservation
+	err   error
+}
+
+// Done - returns a channel closed once the request is granted
+// a slot or timed out
+func (s *Pending) Done() <-chan struct{} {
+	return s.w.done
+}
+
+// Wait - waits until the request is granted a slot or times out.
+// Returns the reservation of the slot, or ErrNoSlotsAvailable.
+func (s *Pending) Wait() (*Reservation, error) {
+	// With the WakeNotify strategy, poll stays nil and
+	// never fires.
+	var poll <-chan time.Time
+	if s.rl.settings.WakeStrategy == WakePoll {
+		tkr := s.rl.clock.NewTicker(s.rl.settings.PollInterval)
+		defer tkr.Stop()
+		poll = tkr.C()
+	}
+	for {
+		select {
+		case <-s.w.done:
+			return s.outcome()
+		case <-poll:
+			// The bursts are reset lazily
+			s.rl.reset()
+		}
+	}
+}
+
+// outcome - returns the outcome of the request once it left
+// the queue, always the same one
+func (s *Pending) outcome() (*Reservation, error) {
+	s.once.Do(func() {
+		s.timer.Stop()
+		if s.w.burst == nil {
+			// Leave the queue without a slot
+			s.rl.logger.Debug("leaving slot queue without a slot")
+			s.err = ErrNoSlotsAvailable
+			return
+		}
+		// Leave the queue with a slot
+		s.rl.logger.Debug("leaving slot queue with a slot")
+		s.r = &Reservation{rl: s.rl, burst: s.w.burst, ticket: s.w.ticket, slots: s.w.slots}
+	})
+	return s.r, s.err
+}
@@ -0,0 +1,294 @@
+package rlmu
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"time"
+)
+
+// Ticket - describes a request for a burst slot
+type Ticket struct {
+	// Priority of the request. A freed slot goes to the waiter
+	// with the highest priority.
+	Priority int
+	// Flow identifies the downstream client of the request. The
+	// slots are shared among the queued flows of a priority by
+	// deficit round-robin.
+	Flow string
+	// Weight of the flow, a flow gets a share of the slots
+	// proportional to its weight. Defaults to 1.
+	Weight int
+	// Plan the customer plan of the flow, the minimum
+	// shares of the slots are reserved per plan
+	Plan string
+	// Slots the number of slots of a burst the request uses, at
+	// most the burst limit. Defaults to 1.
+	Slots int
+}
+
+// weight - the weight of the ticket flow
+func (s Ticket) weight() int {
+	return max(s.Weight, 1)
+}
+
+// slots - the number of slots the ticket takes in a burst of
+// the limit
+func (s Ticket) slots(limit int) int {
+	return max(min(s.Slots, limit), 1)
+}
+
+// waiter - a request waiting in the slot queue
+type waiter struct {
+	ticket Ticket
+	// start the time the waiter was queued
+	start time.Time
+	// done is closed when the waiter leaves the queue,
+	// granted a slot or timed out
+	done chan struct{}
+	// burst the slots were granted in, nil if it timed out
+	burst *Burst
+	// slots the number of slots granted
+	slots int
+}
+
+// flow - the waiters of a downstream client in a priority class
+type flow struct {
+	name    string
+	waiters []*waiter
+	// deficit the number of slots the flow can still be granted
+	// in the current round
+	deficit int
+	// credited is set when the flow got its quantum in the
+	// current round
+	credited bool
+}
+
+// class - the waiters of a priority, served by deficit round-robin
+// across their flows.
+type class struct {
+	flows map[string]*flow
+	// active the flows with waiters, in round-robin order
+	active []*flow
+	// plans the number of waiters per plan
+	plans  map[string]int
+	length int
+}
+
+func newClass() *class {
+	return &class{flows: make(map[string]*flow), plans: make(map[string]int)}
+}
+
+// push - appends a waiter to its flow
+func (s *class) push(w *waiter) {
+	f, ok := s.flows[w.ticket.Flow]
+	if !ok {
+		f = &flow{name: w.ticket.Flow}
+		s.flows[f.name] = f
+		s.active = append(s.active, f)
+	}
+	f.waiters = append(f.waiters, w)
+	s.plans[w.ticket.Plan]++
+	s.length++
+}
+
+// remove - removes a waiter from its flow, returns false if
+// it is not queued.
+func (s *class) remove(w *waiter) bool {
+	f, ok := s.flows[w.ticket.Flow]
+	if !ok {
+		return false
+	}
+	i := slices.Index(f.waiters, w)
+	if i < 0 {
+		return false
+	}
+	f.waiters = slices.Delete(f.waiters, i, i+1)
+	if s.plans[w.ticket.Plan]--; s.plans[w.ticket.Plan] == 0 {
+		delete(s.plans, w.ticket.Plan)
+	}
+	s.length--
+	if len(f.waiters) == 0 {
+		// An idle flow loses its deficit
+		delete(s.flows, f.name)
+		s.active = slices.DeleteFunc(s.active, func(a *flow) bool { return a == f })
+	}
+	return true
+}
+
+// flowOf - returns the first flow in round-robin order whose
+// next waiter is of the plan, nil if there is none
+func (s *class) flowOf(plan string) *flow {
+	for _, f := range s.active {
+		if f.waiters[0].ticket.Plan == plan {
+			return f
+		}
+	}
+	return nil
+}
+
+// head - returns the flow at the head of the round once its deficit
+// covers the slots of its next waiter. At its turn, a flow is credited
+// its weight in slots. A flow whose deficit does not cover its next
+// waiter moves to the back of the round, keeping its deficit for its
+// next turn, so that the slots are shared by weight whatever the number
+// of slots of the waiters. Must not be called on an empty class.
+func (s *class) head(limit int) *flow {
+	for {
+		f := s.active[0]
+		if !f.credited {
+			f.deficit += f.waiters[0].ticket.weight()
+			f.credited = true
+		}
+		if f.deficit >= f.waiters[0].ticket.slots(limit) {
+			return f
+		}
+		s.rotate()
+	}
+}
+
+// serve - removes and returns the next waiter of a flow. The flow at
+// the head of the round, see head, pays the slots of the waiter from
+// its deficit. A flow served out of turn, for the minimum share of its
+// plan, moves to the back of the round without using its deficit.
+func (s *class) serve(f *flow, limit int) *waiter {
+	w := f.waiters[0]
+	n := w.ticket.slots(limit)
+	if f != s.active[0] || !f.credited || f.deficit < n {
+		s.remove(w)
+		if len(f.waiters) > 0 {
+			s.active = slices.DeleteFunc(s.active, func(a *flow) bool { return a == f })
+			f.credited = false
+			s.active = append(s.active, f)
+		}
+		return w
+	}
+	f.deficit -= n
+	s.remove(w)
+	return w
+}
+
+// rotate - moves the flow at the head of the round to its back
+func (s *class) rotate() {
+	f := s.active[0]
+	f.credited = false
+	s.active = append(s.active[1:], f)
+}
+
+// slotQueue - the requests waiting for a burst slot, grouped
+// by priority. It is not safe for concurrent use, the RateLimiter
+// lock protects it.
+type slotQueue struct {
+	// waiters per priority
+	classes map[int]*class
+	// length the number of waiters in all the classes
+	length int
+	// minShares the share of the slots of a burst reserved to the
+	// requests of a plan while they are queued, so that they are not
+	// starved by the higher priorities.
+	minShares map[string]float64
+	// grants the number of slots granted per plan in the
+	// current burst
+	grants map[string]int
+}
+
+func newSlotQueue() *slotQueue {
+	return &slotQueue{
+		classes:   make(map[int]*class),
+		minShares: make(map[string]float64),
+		grants:    make(map[string]int),
+	}
+}
+
+// push - appends a waiter to the queue of its priority
+func (s *slotQueue) push(w *waiter) {
+	c, ok := s.classes[w.ticket.Priority]
+	if !ok {
+		c = newClass()
+		s.classes[w.ticket.Priority] = c
+	}
+	c.push(w)
+	s.length++
+}
+
+// remove - removes a waiter from the queue. Returns false if the
+// waiter is not in the queue anymore, because it was granted a slot.
+func (s *slotQueue) remove(w *waiter) bool {
+	c, ok := s.classes[w.ticket.Priority]
+	if !ok || !c.remove(w) {
+		return false
+	}
+	if c.length == 0 {
+		delete(s.classes, w.ticket.Priority)
+	}
+	s.length--
+	return true
+}
+
+// next - returns the priority and the flow of the waiter the next
+// slot goes to. A plan that did not get its minimum share of the burst
+// limit is served first, otherwise the highest priority is. Within a
+// priority the flows are served by deficit round-robin, in slots.
+// Must not be called on an empty queue.
+func (s *slotQueue) next(limit int) (int, *flow) {
+	priorities := slices.Collect(maps.Keys(s.classes))
+	// Highest priority first
+	slices.SortFunc(priorities, func(a, b int) int { return b - a })
+	for _, priority := range priorities {
+		c := s.classes[priority]
+		plans := slices.Sorted(maps.Keys(c.plans))
+		for _, plan := range plans {
+			share := s.minShares[plan]
+			if share <= 0 || s.grants[plan] >= int(math.Ceil(share*float64(limit))) {
+				continue
+			}
+			if f := c.flowOf(plan); f != nil {
+				return priority, f
+			}
+		}
+	}
+	return priorities[0], s.classes[priorities[0]].head(limit)
+}
+
+// peek - returns the waiter the next slot goes to, without removing
+// it, nil if the queue is empty.
+func (s *slotQueue) peek(limit int) *waiter {
+	if s.length == 0 {
+		return nil
+	}
+	_, f := s.next(limit)
+	return f.waiters[0]
+}
+
+// pop - removes and returns the waiter the next slot goes to,
+// nil if the queue is empty.
+func (s *slotQueue) pop(limit int) *waiter {
+	if s.length == 0 {
+		return nil
+	}
+	priority, f := s.next(limit)
+	c := s.classes[priority]
+	w := c.serve(f, limit)
+	if c.length == 0 {
+		delete(s.classes, priority)
+	}
+	s.length--
+	return w
+}
+
+// granted - records n slots granted to a plan
+func (s *slotQueue) granted(plan string, n int) {
+	s.grants[plan] += n
+}
+
+// released - records n slots given back by a plan
+func (s *slotQueue) released(plan string, n int) {
+	if s.grants[plan] = max(s.grants[plan]-n, 0); s.grants[plan] == 0 {
+		delete(s.grants, plan)
+	}
+}
+
+// resetGrants - starts counting the grants of a new burst
+func (s *slotQueue) resetGrants() {
+	clear(s.grants)
+}
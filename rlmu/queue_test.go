@@ -0,0 +1,259 @@
+package rlmu_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yambabmay/yyabws/server/rlmu"
+)
+
+// queue - queues a slot request, failing the test if it
+// is not queued
+func queue(t *testing.T, rl *rlmu.RateLimiter, ticket rlmu.Ticket) *rlmu.Pending {
+	t.Helper()
+	r, p, err := rl.Queue(ticket)
+	if err != nil || r != nil {
+		t.Fatalf("slot request not queued: %v", err)
+	}
+	return p
+}
+
+// done - returns true if the queued request left the queue
+func done(p *rlmu.Pending) bool {
+	select {
+	case <-p.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// granted - returns the number of the queued requests granted
+// a slot, committing them
+func granted(t *testing.T, ps []*rlmu.Pending) int {
+	t.Helper()
+	n := 0
+	for _, p := range ps {
+		if !done(p) {
+			continue
+		}
+		r, err := p.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Commit()
+		n++
+	}
+	return n
+}
+
+func TestQueueTimesOut(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 1
+	settings.FallbackReset = 10 * time.Second
+	settings.MaxWait = time.Second
+	rl, clock := newLimiter(t, settings)
+	reserve(t, rl, 1)
+	p := queue(t, rl, rlmu.Ticket{})
+	clock.Advance(999 * time.Millisecond)
+	if done(p) {
+		t.Fatal("left the queue before the max wait")
+	}
+	clock.Advance(time.Millisecond)
+	if !done(p) {
+		t.Fatal("still queued after the max wait")
+	}
+	if _, err := p.Wait(); !errors.Is(err, rlmu.ErrNoSlotsAvailable) {
+		t.Fatalf("err = %v, want %v", err, rlmu.ErrNoSlotsAvailable)
+	}
+	if got := rl.Waiting(); got != 0 {
+		t.Fatalf("waiting = %d, want 0", got)
+	}
+}
+
+func TestQueueGrantedOnReset(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 1
+	rl, clock := newLimiter(t, settings)
+	reserve(t, rl, 1)
+	p := queue(t, rl, rlmu.Ticket{})
+	clock.Advance(time.Second)
+	if got := granted(t, []*rlmu.Pending{p}); got != 1 {
+		t.Fatal("not granted a slot on the reset")
+	}
+	if got := rl.Available(); got != 0 {
+		t.Fatalf("available = %d, want 0", got)
+	}
+	if got := rl.Snapshot().WaitP99; got != 1000 {
+		t.Fatalf("wait p99 = %dms, want 1000ms", got)
+	}
+}
+
+func TestQueueGrantedOnRelease(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 1
+	rl, _ := newLimiter(t, settings)
+	r := rl.TryReserve(rlmu.Ticket{})
+	p := queue(t, rl, rlmu.Ticket{})
+	r.Release()
+	if got := granted(t, []*rlmu.Pending{p}); got != 1 {
+		t.Fatal("not granted the released slot")
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 1
+	settings.QueueMax = 1
+	rl, _ := newLimiter(t, settings)
+	reserve(t, rl, 1)
+	queue(t, rl, rlmu.Ticket{})
+	if _, _, err := rl.Queue(rlmu.Ticket{}); !errors.Is(err, rlmu.ErrTooManyWaiting) {
+		t.Fatalf("err = %v, want %v", err, rlmu.ErrTooManyWaiting)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 1
+	rl, _ := newLimiter(t, settings)
+	r := rl.TryReserve(rlmu.Ticket{})
+	low := queue(t, rl, rlmu.Ticket{Priority: 0})
+	high := queue(t, rl, rlmu.Ticket{Priority: 1})
+	r.Release()
+	if !done(high) || done(low) {
+		t.Fatal("the freed slot did not go to the highest priority")
+	}
+}
+
+func TestQueueWeightedFlows(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 3
+	rl, clock := newLimiter(t, settings)
+	reserve(t, rl, 3)
+	var a, b []*rlmu.Pending
+	for range 3 {
+		a = append(a, queue(t, rl, rlmu.Ticket{Flow: "a", Weight: 2}))
+		b = append(b, queue(t, rl, rlmu.Ticket{Flow: "b", Weight: 1}))
+	}
+	clock.Advance(time.Second)
+	if got := granted(t, a); got != 2 {
+		t.Fatalf("flow a granted %d slots, want 2", got)
+	}
+	if got := granted(t, b); got != 1 {
+		t.Fatalf("flow b granted %d slots, want 1", got)
+	}
+}
+
+func TestQueueMixedSlotFlows(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 4
+	rl, clock := newLimiter(t, settings)
+	reserve(t, rl, 4)
+	var a, b []*rlmu.Pending
+	for range 4 {
+		a = append(a, queue(t, rl, rlmu.Ticket{Flow: "a", Slots: 3}))
+		b = append(b, queue(t, rl, rlmu.Ticket{Flow: "b"}))
+	}
+	// Flow a saves its quantum for two rounds before its first
+	// request, the slots left are not enough for it
+	clock.Advance(time.Second)
+	if got := granted(t, a); got != 0 {
+		t.Fatalf("flow a granted %d requests in the first burst, want 0", got)
+	}
+	if got := granted(t, b); got != 2 {
+		t.Fatalf("flow b granted %d requests in the first burst, want 2", got)
+	}
+	// Both flows get the same number of slots
+	clock.Advance(time.Second)
+	if got := granted(t, a[:1]); got != 1 {
+		t.Fatalf("flow a granted %d requests in the second burst, want 1", got)
+	}
+	if got := granted(t, b[2:]); got != 1 {
+		t.Fatalf("flow b granted %d requests in the second burst, want 1", got)
+	}
+}
+
+func TestQueueMinShare(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 2
+	settings.MinShares = map[string]float64{"free": 0.5}
+	rl, clock := newLimiter(t, settings)
+	reserve(t, rl, 2)
+	var pro, free []*rlmu.Pending
+	for range 2 {
+		pro = append(pro, queue(t, rl, rlmu.Ticket{Priority: 1, Plan: "pro"}))
+		free = append(free, queue(t, rl, rlmu.Ticket{Priority: 0, Plan: "free"}))
+	}
+	clock.Advance(time.Second)
+	if got := granted(t, free); got != 1 {
+		t.Fatalf("plan free granted %d slots, want its minimum share of 1", got)
+	}
+	if got := granted(t, pro); got != 1 {
+		t.Fatalf("plan pro granted %d slots, want 1", got)
+	}
+}
+
+func TestQueueWaitBlocks(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 1
+	rl, clock := newLimiter(t, settings)
+	reserve(t, rl, 1)
+	p := queue(t, rl, rlmu.Ticket{})
+	result := make(chan error)
+	go func() {
+		_, err := p.Wait()
+		result <- err
+	}()
+	clock.Advance(time.Second)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueShadowMode(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 1
+	settings.ShadowMode = true
+	rl, _ := newLimiter(t, settings)
+	reserve(t, rl, 1)
+	// Let through at once, without waiting for a slot
+	r, p, err := rl.Queue(rlmu.Ticket{})
+	if err != nil || p != nil || r == nil {
+		t.Fatalf("not let through in shadow mode: %v", err)
+	}
+	r.Commit()
+	if got := rl.Waiting(); got != 0 {
+		t.Fatalf("waiting = %d, want 0", got)
+	}
+	if got := rl.Snapshot().ShadowDenied; got != 1 {
+		t.Fatalf("shadow denied = %d, want 1", got)
+	}
+}
+
+func TestQueueTicketSlots(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 3
+	rl, clock := newLimiter(t, settings)
+	r := rl.TryReserve(rlmu.Ticket{Slots: 2})
+	reserve(t, rl, 1)
+	big := queue(t, rl, rlmu.Ticket{Slots: 3})
+	small := queue(t, rl, rlmu.Ticket{})
+	// The slots released are not enough for the first waiter,
+	// and the one behind it waits too
+	r.Release()
+	if done(big) || done(small) {
+		t.Fatal("granted before the first waiter got its slots")
+	}
+	clock.Advance(time.Second)
+	if !done(big) || done(small) {
+		t.Fatal("the first waiter not granted its slots alone")
+	}
+	if got := granted(t, []*rlmu.Pending{big}); got != 1 {
+		t.Fatal("first waiter not granted")
+	}
+	if got := rl.Available(); got != 0 {
+		t.Fatalf("available = %d, want 0", got)
+	}
+}
@@ -0,0 +1,44 @@
+package rlmu
+
+// Reservation - The burst slots of a ticket granted by the
+// RateLimiter. It is committed when the request reached Atlas, and
+// released when it did not, for instance when the request could not
+// be built or the connection to Atlas failed, so that the slots are
+// not wasted.
+type Reservation struct {
+	rl *RateLimiter
+	// burst the slots were granted in
+	burst  *Burst
+	ticket Ticket
+	// slots the number of slots granted
+	slots int
+	done  bool
+}
+
+// Commit - the request reached Atlas, the slot is used.
+func (s *Reservation) Commit() {
+	s.rl.Lock()
+	defer s.rl.Unlock()
+	s.done = true
+}
+
+// Release - the request did not reach Atlas. The slots go back to
+// the burst they were granted in, and to the queued requests, unless
+// the burst is over.
+func (s *Reservation) Release() {
+	s.rl.Lock()
+	defer s.rl.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	if s.burst != s.rl.burst {
+		// The burst is over, its slots are lost anyway
+		return
+	}
+	s.burst.Release(s.slots)
+	s.rl.queue.released(s.ticket.Plan, s.slots)
+	s.rl.changed()
+	s.rl.logger.Debug("released a burst slot")
+	s.rl.dispatch()
+}
@@ -19,6 +19,11 @@ type Info struct {
 	remaining  int // from  "X-RateLimit-Remaining" header
 	reset      int // from  "X-RateLimit-Reset" header
 	retryAfter int // from  "Retry-After" header
+	// presence of the headers, a missing header
+	// does not override the current state
+	hasLimit     bool
+	hasRemaining bool
+	hasReset     bool
 }
 
 // RlmInfo Extracts the rate limiting information from the headers
@@ -91,6 +96,10 @@ func RlmInfo(header http.Header) (*Info, error) {
 		remaining:  remaining,
 		reset:      reset,
 		retryAfter: retryAfter,
+
+		hasLimit:     strLimit != "",
+		hasRemaining: strRemaining != "",
+		hasReset:     strReset != "",
 	}
 	return rli, nil
 }
@@ -101,107 +110,232 @@ type RateLimiter struct {
 	sync.Mutex
 	// manages the current rate limiting information.
 	burst *Burst
-	// slotQueueLen the number of currently queued requests. To
-	// forward a client request to the request handler has to
-	// acquire a slot in a burst.
-	slotQueueLen int
+	// queue the currently queued requests. To forward a client
+	// request to the request handler has to acquire a slot in a
+	// burst.
+	queue *slotQueue
 	// slotQueueMax is the maximum length of the slot queue. This
-	// defaults to 3 times the value of X-RateLimit-Burst in the
-	// first response from Atlas API
+	// defaults to 10 times the fallback limit, then to 10 times the
+	// X-RateLimit-Limit of the first response from Atlas
 	slotQueueMax int
-	logger       *zap.Logger
-}
-
-// slot - Returns true if a slot is available
-func (s *RateLimiter) slot() bool {
-	s.Lock()
-	defer s.Unlock()
-	return s.burst.Slot()
+	// timer resets the burst when it is over
+	timer Timer
+	clock Clock
+	// window the estimated duration of an Atlas reset period,
+	// the longest X-RateLimit-Reset seen
+	window time.Duration
+	// learned is set once a response from Atlas told the
+	// rate limiting information
+	learned bool
+	// successes the requests that succeeded since the last change
+	// of the adaptive limit
+	successes int
+	// decreased the burst the adaptive limit was last decreased in
+	decreased *Burst
+	// shadowDenied the slot requests denied in shadow mode
+	shadowDenied int
+	// waits the latest times the slot requests waited
+	waits waitTimes
+	// dirty signals a change of the state to save,
+	// nil if the state is not saved
+	dirty    chan struct{}
+	settings *Settings
+	logger   *zap.Logger
 }
 
-// update - Updates the state of the current burst
+// update - Updates the state of the current burst. When the
+// response belongs to a new Atlas reset period, a new burst starts.
 func (s *RateLimiter) update(info *Info) {
 	s.Lock()
 	defer s.Unlock()
+	if s.burst.Rolled(info) {
+		s.logger.Debug("atlas started a new reset period")
+		s.renew()
+	}
 	s.burst.Update(info)
+	if info.hasReset {
+		s.window = max(s.window, time.Duration(info.reset)*time.Millisecond)
+	}
+	s.schedule()
+	s.changed()
+}
+
+// renew - starts a new burst. Until a response from Atlas tells
+// otherwise, the burst is assumed to last as long as the previous
+// ones, so that it is reset even if no response comes back.
+// Must be called with the lock held.
+func (s *RateLimiter) renew() {
+	s.burst = &Burst{
+		limit:     s.burst.limit,
+		nextReset: s.clock.Now().Add(s.window),
+		estimated: true,
+		clock:     s.clock,
+		logger:    s.logger,
+	}
+	s.queue.resetGrants()
+}
+
+// schedule - arms the timer at the end of the current burst.
+// Must be called with the lock held.
+func (s *RateLimiter) schedule() {
+	deadline := s.burst.Deadline()
+	if deadline.IsZero() {
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = s.clock.AfterFunc(deadline.Sub(s.clock.Now()), s.reset)
 }
 
-// reset - performs the reset action
+// reset - performs the reset action, and hands the free slots
+// over to the queued requests.
 func (s *RateLimiter) reset() {
 	s.Lock()
 	defer s.Unlock()
 	if s.burst.Reset() {
-		s.burst = &Burst{
-			limit:  s.burst.limit,
-			logger: s.logger,
-		}
+		s.renew()
+		s.schedule()
 	}
+	s.dispatch()
 }
 
-// enqueue - allocate a place in the slot queue.
-// returns true on success
-func (s *RateLimiter) enqueue() (success bool) {
+// Close - stops resetting the bursts and saving the state
+func (s *RateLimiter) Close() {
 	s.Lock()
 	defer s.Unlock()
-	if s.slotQueueLen < s.slotQueueMax {
-		s.slotQueueLen++
-		success = true
+	if s.timer != nil {
+		s.timer.Stop()
 	}
-	return success
+	if s.dirty != nil {
+		close(s.dirty)
+		s.dirty = nil
+	}
+}
+
+// dispatch - grants the free slots of the burst to the queued
+// requests, in the order of the queue. A request that needs more
+// slots than are free waits for them, the ones behind it too. The
+// round-robin of the queue only moves on while there are free slots.
+// Must be called with the lock held.
+func (s *RateLimiter) dispatch() {
+	for s.queue.length > 0 && s.burst.Available() > 0 {
+		w := s.queue.peek(s.burst.limit)
+		n := w.ticket.slots(s.burst.limit)
+		if !s.burst.Slot(n) {
+			return
+		}
+		s.queue.pop(s.burst.limit)
+		s.queue.granted(w.ticket.Plan, n)
+		s.waits.add(s.clock.Now().Sub(w.start))
+		w.burst = s.burst
+		w.slots = n
+		close(w.done)
+		s.changed()
+	}
+}
+
+// grant - grants the slots of a ticket without queueing, if no
+// request is queued before this one. Returns the reservation of
+// the slots or nil. Must be called with the lock held.
+func (s *RateLimiter) grant(t Ticket) *Reservation {
+	n := t.slots(s.burst.limit)
+	if s.queue.length == 0 && s.burst.Slot(n) {
+		s.queue.granted(t.Plan, n)
+		s.changed()
+		return &Reservation{rl: s, burst: s.burst, ticket: t, slots: n}
+	}
+	return nil
 }
 
-// dequeue - frees a previously allocated slot
-// queue place.
-func (s *RateLimiter) dequeue() {
+// TryReserve - tries to reserve a burst slot without waiting
+// in the slot queue. Returns nil if there is no free slot.
+func (s *RateLimiter) TryReserve(t Ticket) *Reservation {
+	// reset the slot, if necessary.
+	s.reset()
+	s.Lock()
+	defer s.Unlock()
+	return s.grant(t)
+}
+
+// Available - returns the number of free slots in the current burst
+func (s *RateLimiter) Available() int {
+	s.reset()
 	s.Lock()
 	defer s.Unlock()
-	if s.slotQueueLen > 0 {
-		s.slotQueueLen--
+	return s.burst.Available()
+}
+
+// Reserve - tries to reserve a burst slot. When there is none, the
+// request waits in the slot queue, where the freed slots go to the
+// highest priority requests first. The reservation has to be
+// committed once the request reached Atlas, or released if it
+// did not.
+func (s *RateLimiter) Reserve(t Ticket) (*Reservation, error) {
+	r, p, err := s.Queue(t)
+	if p == nil {
+		return r, err
 	}
+	return p.Wait()
 }
 
-// Slot - tries to acquire a burst slot
-func (s *RateLimiter) Slot() bool {
+// Queue - tries to reserve a burst slot like Reserve, without waiting
+// for it. When there is none, the request is queued, and the returned
+// Pending tells when it is granted a slot or times out.
+func (s *RateLimiter) Queue(t Ticket) (*Reservation, *Pending, error) {
 	// reset the slot, if necessary.
 	s.reset()
+	s.Lock()
 	// try to get a slot
-	if s.slot() {
-		return true
+	if r := s.grant(t); r != nil {
+		s.waits.add(0)
+		s.Unlock()
+		return r, nil, nil
+	}
+	if s.settings.ShadowMode {
+		// In shadow mode the requests never wait, the ones
+		// without a free slot are let through at once
+		s.Unlock()
+		r, err := s.shadowed(t, ErrNoSlotsAvailable)
+		return r, nil, err
 	}
 	// try get a place on the queue
-	if s.enqueue() {
-		// go and wait for a slot
-		return s.WaitForSlot()
-	}
-	// There is no place in the queue
-	s.logger.Debug("slot queue is full")
-	return false
-}
-
-func (s *RateLimiter) WaitForSlot() bool {
-	// Prepare to free the queue place
-	defer s.dequeue()
-	// Wait a maximum of 4 seconds in the queue.
-	tmr := time.NewTimer(4 * time.Second)
-	defer tmr.Stop()
-	tkr := time.NewTicker(10 * time.Millisecond)
-	defer tkr.Stop()
-	for {
-		select {
-		case <-tmr.C:
-			// Leave the queue without a slot
-			s.logger.Debug("leaving slot queue without a slot")
-			return false
-		default:
-			s.reset()
-			if s.slot() {
-				s.logger.Debug("leaving slot queue with a slot")
-				// Leave the queue with a slot
-				return true
-			}
-			<-tkr.C
-		}
+	if s.queue.length >= s.slotQueueMax {
+		s.Unlock()
+		// There is no place in the queue
+		s.logger.Debug("slot queue is full")
+		return nil, nil, ErrTooManyWaiting
 	}
+	w := &waiter{ticket: t, start: s.clock.Now(), done: make(chan struct{})}
+	s.queue.push(w)
+	// Wait a maximum of MaxWait in the queue. The waiter is removed
+	// from the queue by the timer itself, so that it is granted a
+	// slot or times out at a definite time.
+	timer := s.clock.AfterFunc(s.settings.MaxWait, func() { s.expire(w) })
+	s.Unlock()
+	return nil, &Pending{rl: s, w: w, timer: timer}, nil
+}
+
+// expire - removes a waiter from the slot queue once it waited
+// the maximum wait time, unless it was granted a slot
+func (s *RateLimiter) expire(w *waiter) {
+	s.Lock()
+	defer s.Unlock()
+	if s.queue.remove(w) {
+		s.waits.add(s.clock.Now().Sub(w.start))
+		close(w.done)
+	}
+}
+
+// Slot - tries to acquire a burst slot, waiting in the slot queue
+// if necessary. The slot is committed at once.
+func (s *RateLimiter) Slot(t Ticket) bool {
+	r, err := s.Reserve(t)
+	if err != nil {
+		return false
+	}
+	r.Commit()
+	return true
 }
 
 // Update called from request handlers to update the
@@ -219,25 +353,70 @@ func (s *RateLimiter) Update(header http.Header) {
 		zap.Int("Retry-After", info.retryAfter),
 	)
 	s.update(info)
+	if info.hasLimit {
+		s.Lock()
+		if !s.learned && s.settings.QueueMax == 0 {
+			s.slotQueueMax = info.limit * 10
+		}
+		s.learned = true
+		s.Unlock()
+	}
 	s.reset()
 }
 
-// New - Creates a new RateLimiter
-func New(header http.Header, logger *zap.Logger) (rl *RateLimiter, err error) {
-	info, err := RlmInfo(header)
-	if err != nil {
+// Waiting - returns the number of requests in the slot queue
+func (s *RateLimiter) Waiting() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queue.length
+}
+
+// Learned - returns true once the rate limiting information of
+// Atlas replaced the initial one.
+func (s *RateLimiter) Learned() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.learned
+}
+
+// New - Creates a new RateLimiter. It starts from the fallback limits
+// of the settings, and learns the ones of Atlas from the headers of
+// the responses passed to Update.
+func New(settings *Settings, logger *zap.Logger) (rl *RateLimiter, err error) {
+	if err := settings.Validate(); err != nil {
 		return nil, err
 	}
+	info := &Info{
+		limit:    settings.FallbackLimit,
+		burst:    settings.FallbackLimit,
+		reset:    int(settings.FallbackReset.Milliseconds()),
+		hasLimit: true,
+		hasReset: true,
+	}
+	queue := newSlotQueue()
+	for plan, share := range settings.MinShares {
+		queue.minShares[plan] = share
+	}
+	clock := settings.Clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
 	rl = &RateLimiter{
 		logger: logger,
+		clock:  clock,
 		burst: &Burst{
+			clock:  clock,
 			logger: logger,
 		},
-		// Allow a queue of 10 times the initial value of X-RateLimit-Limit
-		// requests. This can be prohibitive if info.limit is too large. In
-		// a production scenario this should be a configurable setting or
-		// calculated from the information on the available resources.
-		slotQueueMax: info.limit * 10,
+		queue:        queue,
+		settings:     settings,
+		slotQueueMax: settings.QueueMax,
+	}
+	if rl.slotQueueMax == 0 {
+		// Allow a queue of 10 times the fallback limit until the
+		// X-RateLimit-Limit of Atlas is learned, see Update. This can
+		// be prohibitive if the limit is too large.
+		rl.slotQueueMax = info.limit * 10
 	}
 	rl.update(info)
 	return rl, nil
@@ -0,0 +1,233 @@
+package rlmu_test
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yambabmay/yyabws/server/rlmu"
+	"github.com/yambabmay/yyabws/server/rlmu/sim"
+	"go.uber.org/zap"
+)
+
+// newLimiter - creates a rate limiter driven by a virtual clock
+// starting at the Unix epoch
+func newLimiter(t *testing.T, settings *rlmu.Settings) (*rlmu.RateLimiter, *sim.Clock) {
+	t.Helper()
+	clock := sim.NewClock(time.Unix(0, 0))
+	settings.Clock = clock
+	rl, err := rlmu.New(settings, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rl.Close)
+	return rl, clock
+}
+
+// header - returns the rate limiting headers of an Atlas response
+func header(limit, remaining, reset int) http.Header {
+	h := http.Header{}
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(reset))
+	return h
+}
+
+// reserve - takes n slots without waiting, failing the test
+// if one is not granted
+func reserve(t *testing.T, rl *rlmu.RateLimiter, n int) {
+	t.Helper()
+	for i := range n {
+		r := rl.TryReserve(rlmu.Ticket{})
+		if r == nil {
+			t.Fatalf("slot %d not granted", i)
+		}
+		r.Commit()
+	}
+}
+
+func TestLearned(t *testing.T) {
+	rl, _ := newLimiter(t, rlmu.DefaultSettings())
+	if rl.Learned() {
+		t.Fatal("learned before any response from atlas")
+	}
+	rl.Update(http.Header{})
+	if rl.Learned() {
+		t.Fatal("learned from a response without X-RateLimit-Limit")
+	}
+	rl.Update(header(10, 10, 1000))
+	if !rl.Learned() {
+		t.Fatal("not learned from X-RateLimit-Limit")
+	}
+	if got := rl.Available(); got != 10 {
+		t.Fatalf("available = %d, want 10", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	rl, clock := newLimiter(t, rlmu.DefaultSettings())
+	h := header(5, 5, 1000)
+	h.Set("Retry-After", "2")
+	rl.Update(h)
+	if got := rl.Available(); got != 0 {
+		t.Fatalf("available = %d during Retry-After, want 0", got)
+	}
+	if r := rl.TryReserve(rlmu.Ticket{}); r != nil {
+		t.Fatal("slot granted during Retry-After")
+	}
+	// The lockout outlasts the reset period
+	clock.Advance(time.Second)
+	if got := rl.Available(); got != 0 {
+		t.Fatalf("available = %d after the reset, want 0", got)
+	}
+	clock.Advance(time.Second)
+	if got := rl.Available(); got != 5 {
+		t.Fatalf("available = %d after Retry-After, want 5", got)
+	}
+}
+
+func TestRetryAfterQueued(t *testing.T) {
+	rl, clock := newLimiter(t, rlmu.DefaultSettings())
+	h := header(5, 5, 1000)
+	h.Set("Retry-After", "2")
+	rl.Update(h)
+	_, p, err := rl.Queue(rlmu.Ticket{})
+	if err != nil || p == nil {
+		t.Fatalf("not queued: %v", err)
+	}
+	clock.Advance(2*time.Second - time.Millisecond)
+	select {
+	case <-p.Done():
+		t.Fatal("granted during Retry-After")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case <-p.Done():
+	default:
+		t.Fatal("not granted after Retry-After")
+	}
+	if _, err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 4
+	rl, _ := newLimiter(t, settings)
+	rl.Observe(http.StatusTooManyRequests, 0)
+	if got := rl.Available(); got != 2 {
+		t.Fatalf("available = %d after a 429, want 2", got)
+	}
+	// The limit decreases once per burst
+	rl.Observe(http.StatusServiceUnavailable, 0)
+	if got := rl.Available(); got != 2 {
+		t.Fatalf("available = %d after a second congestion, want 2", got)
+	}
+	// It increases once as many requests as the limit succeeded
+	rl.Observe(http.StatusOK, 0)
+	rl.Observe(http.StatusOK, 0)
+	if got := rl.Available(); got != 3 {
+		t.Fatalf("available = %d after 2 successes, want 3", got)
+	}
+	// Atlas limits win over the adaptive mode
+	rl.Update(header(10, 10, 1000))
+	rl.Observe(http.StatusTooManyRequests, 0)
+	if got := rl.Available(); got != 10 {
+		t.Fatalf("available = %d once learned, want 10", got)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	store, err := rlmu.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &rlmu.State{
+		Limit:     10,
+		Slots:     7,
+		NextReset: time.Unix(0, 0).Add(500 * time.Millisecond),
+		Window:    time.Second,
+	}
+	if err := store.Save(context.Background(), "atlas", state); err != nil {
+		t.Fatal(err)
+	}
+	rl, clock := newLimiter(t, rlmu.DefaultSettings())
+	if err := rl.Restore(context.Background(), store, "atlas"); err != nil {
+		t.Fatal(err)
+	}
+	if got := rl.Available(); got != 3 {
+		t.Fatalf("available = %d after restore, want 3", got)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if got := rl.Available(); got != 10 {
+		t.Fatalf("available = %d after the restored reset, want 10", got)
+	}
+}
+
+func TestRestoreOver(t *testing.T) {
+	store, err := rlmu.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A burst over before the restart
+	state := &rlmu.State{Limit: 10, Slots: 10, NextReset: time.Unix(0, 0)}
+	if err := store.Save(context.Background(), "atlas", state); err != nil {
+		t.Fatal(err)
+	}
+	rl, _ := newLimiter(t, rlmu.DefaultSettings())
+	if err := rl.Restore(context.Background(), store, "atlas"); err != nil {
+		t.Fatal(err)
+	}
+	if got := rl.Available(); got != 10 {
+		t.Fatalf("available = %d after restoring a burst over, want 10", got)
+	}
+}
+
+func TestSimulator(t *testing.T) {
+	settings := rlmu.DefaultSettings()
+	settings.FallbackLimit = 2
+	settings.MaxWait = 1500 * time.Millisecond
+	steps := []sim.Step{
+		{At: 0, Header: header(2, 2, 1000), Try: 3},
+		{At: 100 * time.Millisecond, Wait: 3},
+		{At: time.Second},
+		{At: 1700 * time.Millisecond},
+	}
+	want := []sim.Outcome{
+		{At: 0, Granted: 2, Rejected: 1, Available: 0, Waiting: 0},
+		{At: 100 * time.Millisecond, Granted: 0, Rejected: 0, Available: 0, Waiting: 3},
+		// The burst resets, the first two waiters get its slots
+		{At: time.Second, Granted: 2, Rejected: 0, Available: 0, Waiting: 1},
+		// The last one timed out at 1.6s
+		{At: 1700 * time.Millisecond, Granted: 0, Rejected: 1, Available: 0, Waiting: 0},
+	}
+	for i := range 2 {
+		s, err := sim.New(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Run(steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("run %d: outcomes = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestSimulatorOrder(t *testing.T) {
+	s, err := sim.New(rlmu.DefaultSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Run([]sim.Step{{At: time.Second}, {At: 0}})
+	if err == nil {
+		t.Fatal("steps out of time order accepted")
+	}
+}
@@ -0,0 +1,149 @@
+package rlmu
+
+import (
+	"fmt"
+	"time"
+)
+
+// Wake strategies of the requests waiting in the slot queue
+const (
+	// WakePoll the waiters periodically check if the burst
+	// is over, and hand the free slots over to the queue.
+	WakePoll = "poll"
+	// WakeNotify the waiters only wake up when they are granted
+	// a slot, on a response from Atlas or on a new slot request.
+	WakeNotify = "notify"
+)
+
+// Settings - The settings of the upstream rate limiter
+type Settings struct {
+	// QueueMax The maximum number of requests waiting for a slot,
+	// 0 means 10 times the X-RateLimit-Limit of the first response
+	// from Atlas, and 10 times the FallbackLimit until then
+	// Configurable through the environment
+	// variable US_QUEUE_MAX, defaults to 0
+	QueueMax int
+	// MaxWait The maximum time a request waits for a slot
+	// Configurable through the environment
+	// variable US_MAX_WAIT, defaults to 4s
+	MaxWait time.Duration
+	// WakeStrategy How the waiting requests wake up, WakePoll
+	// or WakeNotify
+	// Configurable through the environment
+	// variable US_WAKE_STRATEGY, defaults to "poll"
+	WakeStrategy string
+	// PollInterval The period of the WakePoll wake strategy
+	// Configurable through the environment
+	// variable US_POLL_INTERVAL, defaults to 10ms
+	PollInterval time.Duration
+	// FallbackLimit The burst limit used until Atlas sends the
+	// X-RateLimit-Limit header
+	// Configurable through the environment
+	// variable US_FALLBACK_LIMIT, defaults to 5
+	FallbackLimit int
+	// FallbackReset The burst duration used until Atlas sends the
+	// X-RateLimit-Reset header
+	// Configurable through the environment
+	// variable US_FALLBACK_RESET, defaults to 1s
+	FallbackReset time.Duration
+	// MinShares The share, between 0 and 1, of the slots of each burst
+	// reserved to the requests of a plan, as long as they are queued.
+	// This keeps the plans of low priority from being starved.
+	MinShares map[string]float64
+	// ShadowMode The slot requests that find no free slot are logged
+	// and counted in the rlmu_shadow_denied metric, but granted a slot
+	// at once instead of waiting in the slot queue
+	// Configurable through the environment
+	// variable US_SHADOW_MODE, defaults to false
+	ShadowMode bool
+	// Adaptive Steers the burst limit by additive increase and
+	// multiplicative decrease while Atlas does not send the
+	// X-RateLimit-Limit header. The limit decreases on a 429, a
+	// server error or a slow response, and increases otherwise.
+	// Configurable through the environment
+	// variable US_ADAPTIVE, defaults to true
+	Adaptive bool
+	// AdaptiveMaxLimit The maximum burst limit of the adaptive mode
+	// Configurable through the environment
+	// variable US_ADAPTIVE_MAX_LIMIT, defaults to 100
+	AdaptiveMaxLimit int
+	// AdaptiveLatency The latency above which a response is slow, and
+	// decreases the burst limit in the adaptive mode
+	// Configurable through the environment
+	// variable US_ADAPTIVE_LATENCY, defaults to 2s
+	AdaptiveLatency time.Duration
+	// AdaptiveDecrease The factor, between 0 and 1, the burst limit is
+	// multiplied by when it decreases in the adaptive mode
+	// Configurable through the environment
+	// variable US_ADAPTIVE_DECREASE, defaults to 0.5
+	AdaptiveDecrease float64
+	// Clock The source of time, defaults to the system clock
+	Clock Clock
+}
+
+// DefaultSettings - Returns the default settings
+func DefaultSettings() *Settings {
+	return &Settings{
+		MaxWait:          4 * time.Second,
+		WakeStrategy:     WakePoll,
+		PollInterval:     10 * time.Millisecond,
+		FallbackLimit:    5,
+		FallbackReset:    time.Second,
+		MinShares:        make(map[string]float64),
+		Adaptive:         true,
+		AdaptiveMaxLimit: 100,
+		AdaptiveLatency:  2 * time.Second,
+		AdaptiveDecrease: 0.5,
+		Clock:            SystemClock{},
+	}
+}
+
+// Validate - Checks the consistency of the settings
+func (s *Settings) Validate() error {
+	if s.QueueMax < 0 {
+		return fmt.Errorf("%w: queue max %d is negative", ErrInvalidSettings, s.QueueMax)
+	}
+	if s.MaxWait <= 0 {
+		return fmt.Errorf("%w: max wait %v is not positive", ErrInvalidSettings, s.MaxWait)
+	}
+	switch s.WakeStrategy {
+	case WakePoll:
+		if s.PollInterval <= 0 {
+			return fmt.Errorf("%w: poll interval %v is not positive", ErrInvalidSettings, s.PollInterval)
+		}
+		if s.PollInterval >= s.MaxWait {
+			return fmt.Errorf("%w: poll interval %v is not shorter than the max wait %v",
+				ErrInvalidSettings, s.PollInterval, s.MaxWait)
+		}
+	case WakeNotify:
+	default:
+		return fmt.Errorf("%w: wake strategy %q is not %q or %q",
+			ErrInvalidSettings, s.WakeStrategy, WakePoll, WakeNotify)
+	}
+	if s.FallbackLimit < 1 {
+		return fmt.Errorf("%w: fallback limit %d is not positive", ErrInvalidSettings, s.FallbackLimit)
+	}
+	if s.FallbackReset <= 0 {
+		return fmt.Errorf("%w: fallback reset %v is not positive", ErrInvalidSettings, s.FallbackReset)
+	}
+	if s.Adaptive {
+		if s.AdaptiveMaxLimit < s.FallbackLimit {
+			return fmt.Errorf("%w: adaptive max limit %d is lower than the fallback limit %d",
+				ErrInvalidSettings, s.AdaptiveMaxLimit, s.FallbackLimit)
+		}
+		if s.AdaptiveLatency <= 0 {
+			return fmt.Errorf("%w: adaptive latency %v is not positive", ErrInvalidSettings, s.AdaptiveLatency)
+		}
+		if s.AdaptiveDecrease <= 0 || s.AdaptiveDecrease >= 1 {
+			return fmt.Errorf("%w: adaptive decrease %v is not in the range ]0 .. 1[",
+				ErrInvalidSettings, s.AdaptiveDecrease)
+		}
+	}
+	for plan, share := range s.MinShares {
+		if share < 0 || share > 1 {
+			return fmt.Errorf("%w: min share %v of plan %q is not in the range [0 .. 1]",
+				ErrInvalidSettings, share, plan)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package rlmu
+
+import (
+	"expvar"
+
+	"go.uber.org/zap"
+)
+
+// shadowDenied - the number of slot requests the rate limiters
+// would have denied in shadow mode
+var shadowDenied = expvar.NewInt("rlmu_shadow_denied")
+
+// shadowed - returns the denial of a slot request, unless the rate
+// limiter is in shadow mode. In shadow mode the denial is recorded and
+// the request is granted a slot outside of the burst at once, which is
+// never given back to it.
+func (s *RateLimiter) shadowed(t Ticket, err error) (*Reservation, error) {
+	if !s.settings.ShadowMode {
+		return nil, err
+	}
+	s.logger.Info("shadow mode, would deny a slot",
+		zap.Int("priority", t.Priority),
+		zap.Error(err))
+	shadowDenied.Add(1)
+	s.Lock()
+	s.shadowDenied++
+	s.Unlock()
+	return &Reservation{rl: s, ticket: t}, nil
+}
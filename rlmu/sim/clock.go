@@ -0,0 +1,162 @@
+// Package sim replays sequences of Atlas responses and slot requests
+// against an upstream rate limiter in virtual time, so that its
+// behavior can be checked deterministically, without real sleeps.
+package sim
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/yambabmay/yyabws/server/rlmu"
+)
+
+// Clock - A virtual rlmu.Clock. Its time only moves when it is
+// advanced, and the timers due are fired in the order of their
+// deadlines. As with the system clock, each callback runs in its own
+// goroutine; the advancing goroutine waits for it to return before
+// moving on, so that the timers fire one at a time.
+type Clock struct {
+	sync.Mutex
+	now     time.Time
+	seq     int
+	timers  []*timer
+	tickers []*ticker
+}
+
+// NewClock - Creates a virtual clock starting at the time start
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+type timer struct {
+	clock    *Clock
+	deadline time.Time
+	// seq orders the timers with the same deadline
+	seq int
+	f   func()
+}
+
+// Stop - removes the timer from the clock
+func (s *timer) Stop() bool {
+	s.clock.Lock()
+	defer s.clock.Unlock()
+	i := slices.Index(s.clock.timers, s)
+	if i < 0 {
+		return false
+	}
+	s.clock.timers = slices.Delete(s.clock.timers, i, i+1)
+	return true
+}
+
+type ticker struct {
+	clock  *Clock
+	period time.Duration
+	next   time.Time
+	c      chan time.Time
+}
+
+func (s *ticker) C() <-chan time.Time {
+	return s.c
+}
+
+// Stop - removes the ticker from the clock
+func (s *ticker) Stop() {
+	s.clock.Lock()
+	defer s.clock.Unlock()
+	s.clock.tickers = slices.DeleteFunc(s.clock.tickers, func(t *ticker) bool { return t == s })
+}
+
+// Now - returns the virtual time
+func (s *Clock) Now() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return s.now
+}
+
+// AfterFunc - calls f in its own goroutine when the clock is
+// advanced past the duration d
+func (s *Clock) AfterFunc(d time.Duration, f func()) rlmu.Timer {
+	s.Lock()
+	defer s.Unlock()
+	s.seq++
+	t := &timer{clock: s, deadline: s.now.Add(d), seq: s.seq, f: f}
+	s.timers = append(s.timers, t)
+	return t
+}
+
+// NewTicker - returns a ticker ticking as the clock is advanced. Like
+// the ones of the time package, it drops the ticks for slow receivers.
+func (s *Clock) NewTicker(d time.Duration) rlmu.Ticker {
+	s.Lock()
+	defer s.Unlock()
+	t := &ticker{clock: s, period: d, next: s.now.Add(d), c: make(chan time.Time, 1)}
+	s.tickers = append(s.tickers, t)
+	return t
+}
+
+// Advance - moves the clock forward by the duration d
+func (s *Clock) Advance(d time.Duration) {
+	s.AdvanceTo(s.Now().Add(d))
+}
+
+// AdvanceTo - moves the clock forward to the time end, firing the
+// timers due on the way. The clock is at the deadline of a timer when
+// it fires, and the timers it arms fire too if they are due. It
+// returns once the callbacks of the timers fired have returned.
+func (s *Clock) AdvanceTo(end time.Time) {
+	for {
+		s.Lock()
+		next := s.next(end)
+		if next == nil {
+			if end.After(s.now) {
+				s.now = end
+			}
+			s.tick()
+			s.Unlock()
+			return
+		}
+		s.timers = slices.DeleteFunc(s.timers, func(t *timer) bool { return t == next })
+		if next.deadline.After(s.now) {
+			s.now = next.deadline
+		}
+		s.tick()
+		s.Unlock()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			next.f()
+		}()
+		<-done
+	}
+}
+
+// next - returns the first timer due at the time end, nil if none
+// is. Must be called with the lock held.
+func (s *Clock) next(end time.Time) *timer {
+	var next *timer
+	for _, t := range s.timers {
+		if t.deadline.After(end) {
+			continue
+		}
+		if next == nil || t.deadline.Before(next.deadline) ||
+			(t.deadline.Equal(next.deadline) && t.seq < next.seq) {
+			next = t
+		}
+	}
+	return next
+}
+
+// tick - sends the ticks due to the tickers. Must be called
+// with the lock held.
+func (s *Clock) tick() {
+	for _, t := range s.tickers {
+		for !t.next.After(s.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
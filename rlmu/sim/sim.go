@@ -0,0 +1,143 @@
+package sim
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/yambabmay/yyabws/server/rlmu"
+	"go.uber.org/zap"
+)
+
+// Step - An event of a scenario
+type Step struct {
+	// At the virtual time of the step, since the start of the scenario
+	At time.Duration
+	// Header the headers of an Atlas response passed to
+	// RateLimiter.Update, if not nil
+	Header http.Header
+	// Try the number of slot requests that do not wait
+	Try int
+	// Wait the number of slot requests that wait in the slot queue
+	Wait int
+	// Ticket the ticket of the slot requests
+	Ticket rlmu.Ticket
+}
+
+// Outcome - What happened at a step
+type Outcome struct {
+	At time.Duration
+	// Granted the slot requests granted at the step, the queued
+	// ones of the previous steps included
+	Granted int
+	// Rejected the slot requests rejected at the step: the ones that
+	// did not wait and got no slot, the ones that found the slot queue
+	// full and the queued ones that timed out
+	Rejected int
+	// Available the free slots of the burst after the step
+	Available int
+	// Waiting the requests in the slot queue after the step
+	Waiting int
+}
+
+// Simulator - Replays scenarios against an upstream rate limiter
+// driven by a virtual clock. The scenario runs in a single goroutine:
+// the slot requests that wait are queued without blocking, and their
+// outcomes are collected once the queue answered them.
+type Simulator struct {
+	Clock   *Clock
+	RL      *rlmu.RateLimiter
+	start   time.Time
+	maxWait time.Duration
+	// pending the slot requests waiting in the slot queue
+	pending  []*rlmu.Pending
+	granted  int
+	rejected int
+}
+
+// New - Creates a simulator. The clock of the settings is replaced
+// by a virtual one.
+func New(settings *rlmu.Settings) (*Simulator, error) {
+	start := time.Unix(0, 0)
+	clock := NewClock(start)
+	virtual := *settings
+	virtual.Clock = clock
+	rl, err := rlmu.New(&virtual, zap.NewNop())
+	if err != nil {
+		return nil, err
+	}
+	return &Simulator{Clock: clock, RL: rl, start: start, maxWait: virtual.MaxWait}, nil
+}
+
+// Run - Replays the steps, in the order of their times, and returns
+// their outcomes. The requests still queued after the last step time
+// out before it returns.
+func (s *Simulator) Run(steps []Step) ([]Outcome, error) {
+	outcomes := make([]Outcome, 0, len(steps))
+	for _, step := range steps {
+		at := s.start.Add(step.At)
+		if at.Before(s.Clock.Now()) {
+			return outcomes, errors.New("steps are not in time order")
+		}
+		s.Clock.AdvanceTo(at)
+		if step.Header != nil {
+			s.RL.Update(step.Header)
+		}
+		for range step.Try {
+			r := s.RL.TryReserve(step.Ticket)
+			if r == nil {
+				s.rejected++
+				continue
+			}
+			r.Commit()
+			s.granted++
+		}
+		for range step.Wait {
+			r, p, err := s.RL.Queue(step.Ticket)
+			if p != nil {
+				s.pending = append(s.pending, p)
+				continue
+			}
+			s.count(r, err)
+		}
+		s.collect()
+		outcomes = append(outcomes, Outcome{
+			At:        step.At,
+			Granted:   s.granted,
+			Rejected:  s.rejected,
+			Available: s.RL.Available(),
+			Waiting:   s.RL.Waiting(),
+		})
+		s.granted, s.rejected = 0, 0
+	}
+	// Let the requests left in the queue time out
+	s.Clock.Advance(s.maxWait)
+	s.collect()
+	s.RL.Close()
+	return outcomes, nil
+}
+
+// collect - counts the outcomes of the queued slot requests that
+// left the queue, granted a slot or timed out
+func (s *Simulator) collect() {
+	pending := s.pending[:0]
+	for _, p := range s.pending {
+		select {
+		case <-p.Done():
+			s.count(p.Wait())
+		default:
+			pending = append(pending, p)
+		}
+	}
+	s.pending = pending
+}
+
+// count - counts the outcome of a slot request
+func (s *Simulator) count(r *rlmu.Reservation, err error) {
+	if err != nil {
+		s.rejected++
+		return
+	}
+	r.Commit()
+	s.granted++
+}
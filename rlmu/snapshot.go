@@ -0,0 +1,108 @@
+package rlmu
+
+import (
+	"slices"
+	"time"
+)
+
+// waitSamples - the number of wait times the percentiles
+// are computed on
+const waitSamples = 1024
+
+// waitTimes - the latest times the slot requests waited for a slot,
+// in a ring buffer. It is not safe for concurrent use, the
+// RateLimiter lock protects it.
+type waitTimes struct {
+	samples []time.Duration
+	next    int
+}
+
+// add - records a wait time, replacing the oldest one
+// when the buffer is full
+func (s *waitTimes) add(d time.Duration) {
+	if len(s.samples) < waitSamples {
+		s.samples = append(s.samples, d)
+		return
+	}
+	s.samples[s.next] = d
+	s.next = (s.next + 1) % waitSamples
+}
+
+// percentiles - returns the wait times under which the
+// fractions ps of the recorded ones are
+func (s *waitTimes) percentiles(ps ...float64) []time.Duration {
+	res := make([]time.Duration, len(ps))
+	if len(s.samples) == 0 {
+		return res
+	}
+	sorted := slices.Clone(s.samples)
+	slices.Sort(sorted)
+	for i, p := range ps {
+		res[i] = sorted[min(int(p*float64(len(sorted))), len(sorted)-1)]
+	}
+	return res
+}
+
+// Snapshot - The state of a RateLimiter at a point in time. The
+// durations are in milliseconds.
+type Snapshot struct {
+	// Limit the slots of the burst
+	Limit int `json:"limit"`
+	// Used the slots of the burst granted
+	Used int `json:"used"`
+	// Free the slots of the burst that can be granted
+	Free int `json:"free"`
+	// ResetIn the time until the burst is over
+	ResetIn int64 `json:"reset_in_ms"`
+	// Estimated is set when the end of the burst is estimated from
+	// the previous ones, not told by Atlas
+	Estimated bool `json:"estimated"`
+	// RetryIn the time until the "Retry-After" lockout is
+	// over, 0 if there is none
+	RetryIn int64 `json:"retry_in_ms"`
+	// Learned is set when the limits are the ones of Atlas
+	Learned bool `json:"learned"`
+	// Waiting the requests in the slot queue
+	Waiting int `json:"waiting"`
+	// QueueMax the maximum length of the slot queue
+	QueueMax int `json:"queue_max"`
+	// WaitP50, WaitP90, WaitP99 the percentiles of the latest
+	// times the slot requests waited for a slot
+	WaitP50 int64 `json:"wait_p50_ms"`
+	WaitP90 int64 `json:"wait_p90_ms"`
+	WaitP99 int64 `json:"wait_p99_ms"`
+	// ShadowDenied the slot requests let through without
+	// a free slot in shadow mode
+	ShadowDenied int `json:"shadow_denied"`
+}
+
+// Snapshot - Returns the current state of the rate limiter
+func (s *RateLimiter) Snapshot() *Snapshot {
+	s.Lock()
+	defer s.Unlock()
+	now := s.clock.Now()
+	waits := s.waits.percentiles(0.5, 0.9, 0.99)
+	snapshot := &Snapshot{
+		Learned:      s.learned,
+		Waiting:      s.queue.length,
+		QueueMax:     s.slotQueueMax,
+		WaitP50:      waits[0].Milliseconds(),
+		WaitP90:      waits[1].Milliseconds(),
+		WaitP99:      waits[2].Milliseconds(),
+		ShadowDenied: s.shadowDenied,
+	}
+	s.burst.Lock()
+	defer s.burst.Unlock()
+	snapshot.Limit = s.burst.limit
+	snapshot.Used = s.burst.slots
+	snapshot.Estimated = s.burst.estimated
+	if s.burst.nextReset.After(now) {
+		snapshot.ResetIn = s.burst.nextReset.Sub(now).Milliseconds()
+	}
+	if s.burst.nextRetry.After(now) {
+		snapshot.RetryIn = s.burst.nextRetry.Sub(now).Milliseconds()
+	} else {
+		snapshot.Free = max(s.burst.limit-s.burst.slots, 0)
+	}
+	return snapshot
+}
@@ -0,0 +1,230 @@
+package rlmu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// storeTimeout - the maximum duration of a save of the state
+const storeTimeout = time.Second
+
+// saveDebounce - the time the changes of the state are coalesced
+// for before it is saved, so that a burst of granted slots is
+// saved once
+const saveDebounce = 100 * time.Millisecond
+
+// State - A snapshot of the state of a RateLimiter, saved so that a
+// restarted process does not spend again the slots of the current
+// burst, nor ignore a "Retry-After" lockout.
+type State struct {
+	Limit int `json:"limit"`
+	// Slots the slots used in the burst ending at NextReset
+	Slots     int       `json:"slots"`
+	NextReset time.Time `json:"next_reset"`
+	// NextRetry the end of the "Retry-After" lockout, if any
+	NextRetry time.Time `json:"next_retry"`
+	// Window the estimated duration of an Atlas reset period
+	Window time.Duration `json:"window"`
+}
+
+// Store - Saves and loads the states of the rate limiters
+type Store interface {
+	// Load returns the state saved under the key, nil
+	// if there is none.
+	Load(ctx context.Context, key string) (*State, error)
+	// Save saves the state under the key
+	Save(ctx context.Context, key string, state *State) error
+}
+
+// FileStore - Saves the states in the files of a directory,
+// one file per key.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore - Creates a FileStore saving the states in the
+// directory dir, which is created if necessary.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+// Load - Reads the state of the key from its file
+func (s *FileStore) Load(_ context.Context, key string) (*State, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Save - Writes the state of the key to its file. The file is
+// replaced atomically, a crash never leaves half a state.
+func (s *FileStore) Save(_ context.Context, key string, state *State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+// RedisStore - Saves the states in redis
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore - Creates a RedisStore
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func stateKey(key string) string {
+	return "atlas:rlmu:state:" + key
+}
+
+// Load - Reads the state of the key from redis
+func (s *RedisStore) Load(ctx context.Context, key string) (*State, error) {
+	data, err := s.client.Get(ctx, stateKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Save - Writes the state of the key to redis
+func (s *RedisStore) Save(ctx context.Context, key string, state *State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, stateKey(key), data, 0).Err()
+}
+
+// snapshot - returns the state of the rate limiter.
+// Must be called with the lock held.
+func (s *RateLimiter) snapshot() *State {
+	s.burst.Lock()
+	defer s.burst.Unlock()
+	return &State{
+		Limit:     s.burst.limit,
+		Slots:     s.burst.slots,
+		NextReset: s.burst.nextReset,
+		NextRetry: s.burst.nextRetry,
+		Window:    s.window,
+	}
+}
+
+// Restore - Restores the state saved under the key in the store, and
+// saves the new states there from now on. The used slots and the reset
+// deadline are restored only if the saved burst is not over, and the
+// "Retry-After" lockout only if it is not.
+func (s *RateLimiter) Restore(ctx context.Context, store Store, key string) error {
+	state, err := store.Load(ctx, key)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if state != nil {
+		now := s.clock.Now()
+		s.burst.Lock()
+		if state.Limit > 0 {
+			s.burst.limit = state.Limit
+		}
+		if state.NextReset.After(now) {
+			s.burst.slots = min(state.Slots, s.burst.limit)
+			s.burst.nextReset = state.NextReset
+			s.burst.estimated = false
+		}
+		if state.NextRetry.After(now) {
+			s.burst.nextRetry = state.NextRetry
+		}
+		s.burst.Unlock()
+		if state.Window > 0 {
+			s.window = state.Window
+		}
+		s.schedule()
+		s.logger.Info("restored upstream rate limiter state",
+			zap.Int("limit", state.Limit),
+			zap.Int("slots", state.Slots),
+			zap.Time("nextReset", state.NextReset),
+			zap.Time("nextRetry", state.NextRetry))
+	}
+	if s.dirty == nil {
+		s.dirty = make(chan struct{}, 1)
+		go s.persist(store, key, s.dirty)
+	}
+	return nil
+}
+
+// persist - saves the state of the rate limiter each time it is marked
+// dirty, until the channel is closed. The changes made within the
+// debounce time, or while a save is in progress, are coalesced, only
+// the latest state is written.
+func (s *RateLimiter) persist(store Store, key string, dirty chan struct{}) {
+	for range dirty {
+		debounced := make(chan struct{})
+		s.clock.AfterFunc(saveDebounce, func() { close(debounced) })
+		<-debounced
+		s.Lock()
+		state := s.snapshot()
+		s.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		if err := store.Save(ctx, key, state); err != nil {
+			s.logger.Warn("saving upstream rate limiter state", zap.Error(err))
+		}
+		cancel()
+	}
+}
+
+// changed - marks the state of the rate limiter dirty, so that it is
+// saved. Must be called with the lock held.
+func (s *RateLimiter) changed() {
+	if s.dirty == nil {
+		return
+	}
+	select {
+	case s.dirty <- struct{}{}:
+	default:
+		// A save is already pending
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yambabmay/yyabws/server/rlmd"
+	"go.uber.org/zap"
+)
+
+// rotateRequest - The body of a secret rotation request
+type rotateRequest struct {
+	Secret string `json:"secret"`
+	// Grace the time the old secret keeps working, for
+	// instance "48h", defaults to the RotationGrace setting
+	Grace string `json:"grace,omitempty"`
+}
+
+// rotateResponse - The body of a secret rotation response
+type rotateResponse struct {
+	// Secret the new secret
+	Secret string `json:"secret"`
+	// ExpiresAt the time the old secret expires at
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// deprecation - Tells the client of a rotated secret, with the
+// Deprecation and Sunset headers, that it should move to the new
+// secret before the old one expires. The lifecycle of the secret
+// is the one read by Allow.
+func (s *atlasClient) deprecation(resp http.ResponseWriter, grant *rlmd.Grant) {
+	if grant.DeprecatedAt == nil {
+		return
+	}
+	resp.Header().Set("Deprecation", fmt.Sprintf("@%d", grant.DeprecatedAt.Unix()))
+	if grant.ExpiresAt != nil {
+		resp.Header().Set("Sunset", grant.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// rotateHandler - Rotates a secret. The new secret shares the rate
+// limits of the old one, which keeps working for the grace period.
+func (s *atlasClient) rotateHandler(resp http.ResponseWriter, req *http.Request) {
+	var body rotateRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Secret == "" {
+		writeError(resp, http.StatusBadRequest, "invalid_request", "the body should be a JSON object with a secret")
+		return
+	}
+	grace := s.settings.RotationGrace
+	if body.Grace != "" {
+		var err error
+		grace, err = time.ParseDuration(body.Grace)
+		if err != nil || grace < 0 {
+			writeError(resp, http.StatusBadRequest, "invalid_request", "the grace should be a positive duration")
+			return
+		}
+	}
+	rotated, expiresAt, err := s.ds.Rotate(req.Context(), body.Secret, grace)
+	var stateErr *rlmd.StateError
+	switch {
+	case errors.Is(err, rlmd.ErrInvalidSecret):
+		writeError(resp, http.StatusNotFound, "invalid_secret", "the secret is not valid")
+		return
+	case errors.As(err, &stateErr):
+		code, message := secretStateError(stateErr.State)
+		writeError(resp, http.StatusConflict, code, message)
+		return
+	case errors.Is(err, rlmd.ErrRotated):
+		writeError(resp, http.StatusConflict, "secret_rotated", "the secret was already rotated")
+		return
+	case err != nil:
+		s.logger.Error("rotating a secret", zap.Error(err))
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("secret rotated", zap.Time("expiresAt", expiresAt))
+	writeJSON(resp, http.StatusOK, rotateResponse{Secret: rotated, ExpiresAt: expiresAt})
+}
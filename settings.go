@@ -3,21 +3,199 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/yambabmay/yyabws/server/rlmd"
+	"github.com/yambabmay/yyabws/server/rlmu"
 )
 
 type Settings struct {
-	URL           string
-	Secret        string
+	URL string
+	// Secrets The Atlas secrets, each one has its own upstream
+	// rate limiter
+	// Configurable through the environment variable ATLAS_SECRETS,
+	// a comma separated list, or ATLAS_SECRET for a single secret
+	Secrets []string
+	// UpstreamSelection How the requests are spread across the Atlas
+	// secrets, "least-loaded" or "round-robin"
+	// Configurable through the environment
+	// variable UPSTREAM_SELECTION, defaults to "least-loaded"
+	UpstreamSelection string
+	// UpstreamCooldown The time an Atlas secret is not used after
+	// Atlas answered with 401 or 403
+	// Configurable through the environment
+	// variable UPSTREAM_COOLDOWN, defaults to 5m
+	UpstreamCooldown time.Duration
+	// ProbeBackoff The time before probing again an Atlas secret
+	// whose rate limiting information could not be learned. It
+	// doubles after each failed probe.
+	// Configurable through the environment
+	// variable UPSTREAM_PROBE_BACKOFF, defaults to 1s
+	ProbeBackoff time.Duration
+	// ProbeMaxBackoff The maximum time between two probes
+	// Configurable through the environment
+	// variable UPSTREAM_PROBE_MAX_BACKOFF, defaults to 1m
+	ProbeMaxBackoff time.Duration
+	// UpstreamStateStore Where the state of the upstream rate limiters
+	// is saved, to be restored after a restart: "" for nowhere, "file"
+	// or "redis"
+	// Configurable through the environment
+	// variable US_STATE_STORE, defaults to ""
+	UpstreamStateStore string
+	// UpstreamStatePath The directory of the "file" state store
+	// Configurable through the environment
+	// variable US_STATE_PATH, defaults to "./rlmu-state"
+	UpstreamStatePath string
+	// PlanPriorities The priority of the upstream slot requests per
+	// downstream customer plan. The plans not listed, and the
+	// default plan "", have priority 0.
+	// Configurable through the environment variable PLAN_PRIORITIES,
+	// for instance "free:0,basic:1,premium:2"
+	PlanPriorities map[string]int
+	// PlanMinShares The share of the upstream slots, between 0 and 1,
+	// reserved to the requests of a downstream customer plan when
+	// they are queued, so that low priority plans are not starved.
+	// Configurable through the environment variable PLAN_MIN_SHARES,
+	// for instance "free:0.1"
+	PlanMinShares map[string]float64
+	// PlanWeights The weight of the downstream secrets of a customer
+	// plan when the upstream slots are shared among the queued
+	// secrets of a priority. The plans not listed, and the default
+	// plan "", have weight 1.
+	// Configurable through the environment variable PLAN_WEIGHTS,
+	// for instance "basic:1,premium:3"
+	PlanWeights map[string]int
+	// MaxTake The maximum number of records a client can take in
+	// one request. Above the Atlas page size the records are
+	// collected from several Atlas pages.
+	// Configurable through the environment
+	// variable MAX_TAKE, defaults to 200
+	MaxTake int
+	// RouteCosts The units a request to an endpoint costs the
+	// downstream secret, per TakeCostStep records. Upstream, every
+	// Atlas page uses one slot whatever its cost. The endpoints not
+	// listed cost 1 unit. An Atlas page of an endpoint cannot cost
+	// more than the downstream limits it is charged to.
+	// Configurable through the environment variable ROUTE_COSTS,
+	// for instance "/players/live:2"
+	RouteCosts map[string]int
+	// TakeCostStep The number of records a request is charged the
+	// cost of its endpoint for. A request for more records costs
+	// proportionally more, a paginated request is charged page by page.
+	// Configurable through the environment
+	// variable TAKE_COST_STEP, defaults to 50
+	TakeCostStep int
+	// ETagMaxBodySize The maximum size of a response body the proxy
+	// buffers to compute its ETag, when Atlas does not send one. Larger
+	// bodies are streamed with the ETag in a trailer.
+	// Configurable through the environment
+	// variable ETAG_MAX_BODY_SIZE, defaults to 1048576
+	ETagMaxBodySize int64
+	// RotationGrace The time a rotated secret keeps working, with a
+	// Deprecation header, before it expires. A rotation request
+	// can ask for another one.
+	// Configurable through the environment
+	// variable ROTATION_GRACE, defaults to 168h
+	RotationGrace time.Duration
+	// AdminAddr The address the admin endpoints are served on,
+	// "" to not serve them
+	// Configurable through the environment
+	// variable ADMIN_ADDR, defaults to ""
+	AdminAddr string
+	// AdminToken The bearer token of the admin endpoints that change
+	// the secrets, which are not served without one
+	// Configurable through the environment
+	// variable ADMIN_TOKEN, defaults to ""
+	AdminToken    string
 	dsRlmSettings *rlmd.Settings
+	usRlmSettings *rlmu.Settings
+	transport     *TransportSettings
+}
+
+// TransportSettings - settings of the HTTP client shared by
+// all the requests sent to Atlas.
+type TransportSettings struct {
+	// DialTimeout The maximum time to establish a TCP connection
+	// Configurable through the environment
+	// variable ATLAS_DIAL_TIMEOUT, defaults to 5s
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout The maximum time to wait for a TLS handshake
+	// Configurable through the environment
+	// variable ATLAS_TLS_TIMEOUT, defaults to 5s
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout The maximum time to wait for the response
+	// headers after the request has been written
+	// Configurable through the environment
+	// variable ATLAS_HEADER_TIMEOUT, defaults to 10s
+	ResponseHeaderTimeout time.Duration
+	// BodyReadTimeout The maximum time a read of a response body waits
+	// for data, so that a connection stalled after the headers does not
+	// pin a request handler
+	// Configurable through the environment
+	// variable ATLAS_BODY_READ_TIMEOUT, defaults to 10s
+	BodyReadTimeout time.Duration
+	// Timeout The maximum time of the requests whose response is read
+	// whole by the proxy: the probes of the Atlas secrets and the pages
+	// of the paginated requests. The streamed responses last as long as
+	// the client reads them.
+	// Configurable through the environment
+	// variable ATLAS_TIMEOUT, defaults to 30s
+	Timeout time.Duration
+	// IdleConnTimeout The maximum time an idle connection stays in the pool
+	// Configurable through the environment
+	// variable ATLAS_IDLE_TIMEOUT, defaults to 90s
+	IdleConnTimeout time.Duration
+	// MaxIdleConns The maximum number of idle connections kept in the pool
+	// Configurable through the environment
+	// variable ATLAS_MAX_IDLE_CONNS, defaults to 100
+	MaxIdleConns int
+	// MaxConnsPerHost The maximum number of connections to Atlas,
+	// 0 means no limit
+	// Configurable through the environment
+	// variable ATLAS_MAX_CONNS_PER_HOST, defaults to 0
+	MaxConnsPerHost int
 }
 
 const (
+	// Default timeouts of the Atlas HTTP client
+	defaultDialTimeout           = 5 * time.Second
+	defaultTLSHandshakeTimeout   = 5 * time.Second
+	defaultResponseHeaderTimeout = 10 * time.Second
+	defaultBodyReadTimeout       = 10 * time.Second
+	defaultTimeout               = 30 * time.Second
+	defaultIdleConnTimeout       = 90 * time.Second
+	// Default size of the Atlas connection pool
+	defaultMaxIdleConns = 100
+	// Default time an Atlas secret rejected by Atlas is not used
+	defaultUpstreamCooldown = 5 * time.Minute
+	// Default backoff of the probes of the Atlas secrets
+	defaultProbeBackoff    = time.Second
+	defaultProbeMaxBackoff = time.Minute
+	// Default directory of the upstream rate limiters states
+	defaultUpstreamStatePath = "./rlmu-state"
+	// Default time a rotated secret keeps working
+	defaultRotationGrace = 7 * 24 * time.Hour
+	// Default maximum number of records in a response
+	defaultMaxTake = 200
+	// Default maximum size of a body to compute an ETag for
+	defaultETagMaxBodySize = 1 << 20
 	// Default requests per second
 	defaultRequestsPerSecond = 5
+	// Default time a request in flight is counted
+	defaultInFlightTTL = time.Minute
+	// Default protection against the enumeration of the secrets
+	defaultAuthFailureWindow = time.Minute
+	defaultAuthLockout       = time.Minute
+	defaultAuthMaxLockout    = time.Hour
+	defaultNegativeCacheTTL  = time.Minute
+	// Default penalty box policy
+	defaultPenaltyWindow        = time.Minute
+	defaultPenaltySuspension    = time.Minute
+	defaultPenaltyMaxSuspension = time.Hour
 	// Maximum number of retries of a redis transaction
 	dbMaxRetries = 5
 	// Default location of the secrets file
@@ -32,6 +210,7 @@ func dsStreamRlmSettings() *rlmd.Settings {
 		RedisMaxRetries:   dbMaxRetries,
 		SecretsFile:       defaultSecretsFile,
 		RequestsPerSecond: defaultRequestsPerSecond,
+		InFlightTTL:       defaultInFlightTTL,
 	}
 	host := os.Getenv("REDIS_HOST")
 	if host != "" {
@@ -69,6 +248,53 @@ func dsStreamRlmSettings() *rlmd.Settings {
 		}
 		settings.RequestsPerSecond = val
 	}
+	nmc := os.Getenv("DS_NOT_MODIFIED_COST")
+	if nmc != "" {
+		val, err := strconv.Atoi(nmc)
+		if err != nil {
+			log.Fatal(fmt.Errorf("converting `DS_NOT_MODIFIED_COST` value to int %v", err))
+		}
+		settings.NotModifiedCost = val
+	}
+	settings.ShadowMode = envBool("DS_SHADOW_MODE", settings.ShadowMode)
+	settings.GlobalRequestsPerSecond = envInt("DS_GLOBAL_REQUESTS_PER_SECOND", settings.GlobalRequestsPerSecond)
+	settings.Auth = rlmd.AuthSettings{
+		MaxFailures:      envInt("DS_AUTH_MAX_FAILURES", 0),
+		FailureWindow:    envDuration("DS_AUTH_FAILURE_WINDOW", defaultAuthFailureWindow),
+		Lockout:          envDuration("DS_AUTH_LOCKOUT", defaultAuthLockout),
+		MaxLockout:       envDuration("DS_AUTH_MAX_LOCKOUT", defaultAuthMaxLockout),
+		NegativeCacheTTL: envDuration("DS_NEGATIVE_CACHE_TTL", defaultNegativeCacheTTL),
+	}
+	if settings.Auth.MaxFailures > 0 && (settings.Auth.FailureWindow <= 0 ||
+		settings.Auth.Lockout <= 0 || settings.Auth.MaxLockout < settings.Auth.Lockout) {
+		log.Fatal("env variables DS_AUTH_FAILURE_WINDOW, DS_AUTH_LOCKOUT and DS_AUTH_MAX_LOCKOUT should be positive, the lockouts increasing")
+	}
+	for _, cidr := range strings.Split(os.Getenv("DS_AUTH_TRUSTED_PROXIES"), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatal(fmt.Errorf("converting `DS_AUTH_TRUSTED_PROXIES` value to CIDR %v", err))
+		}
+		settings.Auth.TrustedProxies = append(settings.Auth.TrustedProxies, network)
+	}
+	settings.Penalty = rlmd.PenaltySettings{
+		Denials:       envInt("DS_PENALTY_DENIALS", 0),
+		Window:        envDuration("DS_PENALTY_WINDOW", defaultPenaltyWindow),
+		Suspension:    envDuration("DS_PENALTY_SUSPENSION", defaultPenaltySuspension),
+		MaxSuspension: envDuration("DS_PENALTY_MAX_SUSPENSION", defaultPenaltyMaxSuspension),
+	}
+	if settings.Penalty.Denials > 0 && (settings.Penalty.Window <= 0 ||
+		settings.Penalty.Suspension <= 0 || settings.Penalty.MaxSuspension < settings.Penalty.Suspension) {
+		log.Fatal("env variables DS_PENALTY_WINDOW, DS_PENALTY_SUSPENSION and DS_PENALTY_MAX_SUSPENSION should be positive, the suspensions increasing")
+	}
+	settings.MaxInFlight = envInt("DS_MAX_IN_FLIGHT", settings.MaxInFlight)
+	settings.InFlightTTL = envDuration("DS_IN_FLIGHT_TTL", settings.InFlightTTL)
+	if settings.InFlightTTL <= 0 {
+		log.Fatal("env variable DS_IN_FLIGHT_TTL should be positive")
+	}
+	settings.EndpointRequestsPerSecond = envMap("DS_ENDPOINT_REQUESTS_PER_SECOND", strconv.Atoi)
 	mr := os.Getenv("REDIS_MAX_RETRIES")
 	if mr != "" {
 		val, err := strconv.Atoi(rps)
@@ -80,21 +306,225 @@ func dsStreamRlmSettings() *rlmd.Settings {
 	return settings
 }
 
+// envDuration - reads a time.Duration from the environment variable
+// name, returns def if the variable is not set.
+func envDuration(name string, def time.Duration) time.Duration {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	val, err := time.ParseDuration(str)
+	if err != nil {
+		log.Fatal(fmt.Errorf("converting `%s` value to duration %v", name, err))
+	}
+	return val
+}
+
+// envInt - reads an int from the environment variable name,
+// returns def if the variable is not set.
+func envInt(name string, def int) int {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	val, err := strconv.Atoi(str)
+	if err != nil {
+		log.Fatal(fmt.Errorf("converting `%s` value to int %v", name, err))
+	}
+	return val
+}
+
+// envBool - reads a bool from the environment variable name,
+// returns def if the variable is not set.
+func envBool(name string, def bool) bool {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	val, err := strconv.ParseBool(str)
+	if err != nil {
+		log.Fatal(fmt.Errorf("converting `%s` value to bool %v", name, err))
+	}
+	return val
+}
+
+// envFloat - reads a float64 from the environment variable name,
+// returns def if the variable is not set.
+func envFloat(name string, def float64) float64 {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		log.Fatal(fmt.Errorf("converting `%s` value to float %v", name, err))
+	}
+	return val
+}
+
+// envMap - reads a comma separated list of "<key>:<value>" pairs from
+// the environment variable name. Each value is converted with parse.
+func envMap[T any](name string, parse func(string) (T, error)) map[string]T {
+	m := make(map[string]T)
+	str := os.Getenv(name)
+	if str == "" {
+		return m
+	}
+	for _, pair := range strings.Split(str, ",") {
+		key, val, ok := strings.Cut(pair, ":")
+		if !ok {
+			log.Fatal(fmt.Errorf("`%s` entry %q is not <key>:<value>", name, pair))
+		}
+		v, err := parse(strings.TrimSpace(val))
+		if err != nil {
+			log.Fatal(fmt.Errorf("converting `%s` value of %q %v", name, key, err))
+		}
+		m[strings.TrimSpace(key)] = v
+	}
+	return m
+}
+
+// Get the upstream rate limiter settings from the environment,
+// with the minimum shares of the customer plans.
+func usRlmSettings(planMinShares map[string]float64) *rlmu.Settings {
+	settings := rlmu.DefaultSettings()
+	settings.QueueMax = envInt("US_QUEUE_MAX", settings.QueueMax)
+	settings.MaxWait = envDuration("US_MAX_WAIT", settings.MaxWait)
+	if strategy := os.Getenv("US_WAKE_STRATEGY"); strategy != "" {
+		settings.WakeStrategy = strategy
+	}
+	settings.PollInterval = envDuration("US_POLL_INTERVAL", settings.PollInterval)
+	settings.FallbackLimit = envInt("US_FALLBACK_LIMIT", settings.FallbackLimit)
+	settings.FallbackReset = envDuration("US_FALLBACK_RESET", settings.FallbackReset)
+	settings.ShadowMode = envBool("US_SHADOW_MODE", settings.ShadowMode)
+	settings.Adaptive = envBool("US_ADAPTIVE", settings.Adaptive)
+	settings.AdaptiveMaxLimit = envInt("US_ADAPTIVE_MAX_LIMIT", settings.AdaptiveMaxLimit)
+	settings.AdaptiveLatency = envDuration("US_ADAPTIVE_LATENCY", settings.AdaptiveLatency)
+	settings.AdaptiveDecrease = envFloat("US_ADAPTIVE_DECREASE", settings.AdaptiveDecrease)
+	for plan, share := range planMinShares {
+		settings.MinShares[plan] = share
+	}
+	if err := settings.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	return settings
+}
+
+// Get the settings of the Atlas HTTP client from the environment
+func transportSettings() *TransportSettings {
+	settings := &TransportSettings{
+		DialTimeout:           envDuration("ATLAS_DIAL_TIMEOUT", defaultDialTimeout),
+		TLSHandshakeTimeout:   envDuration("ATLAS_TLS_TIMEOUT", defaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: envDuration("ATLAS_HEADER_TIMEOUT", defaultResponseHeaderTimeout),
+		BodyReadTimeout:       envDuration("ATLAS_BODY_READ_TIMEOUT", defaultBodyReadTimeout),
+		Timeout:               envDuration("ATLAS_TIMEOUT", defaultTimeout),
+		IdleConnTimeout:       envDuration("ATLAS_IDLE_TIMEOUT", defaultIdleConnTimeout),
+		MaxIdleConns:          envInt("ATLAS_MAX_IDLE_CONNS", defaultMaxIdleConns),
+		MaxConnsPerHost:       envInt("ATLAS_MAX_CONNS_PER_HOST", 0),
+	}
+	if settings.DialTimeout <= 0 || settings.TLSHandshakeTimeout <= 0 ||
+		settings.ResponseHeaderTimeout <= 0 || settings.BodyReadTimeout <= 0 ||
+		settings.Timeout <= 0 || settings.IdleConnTimeout <= 0 {
+		log.Fatal("env variables ATLAS_DIAL_TIMEOUT, ATLAS_TLS_TIMEOUT, ATLAS_HEADER_TIMEOUT, ATLAS_BODY_READ_TIMEOUT, ATLAS_TIMEOUT and ATLAS_IDLE_TIMEOUT should be positive")
+	}
+	return settings
+}
+
 func loadSettings() *Settings {
 	settings := &Settings{}
 
-	secret := os.Getenv("ATLAS_SECRET")
-	if secret == "" {
-		log.Fatal("env variable ATLAS_SECRET is not set")
+	for _, secret := range strings.Split(os.Getenv("ATLAS_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			settings.Secrets = append(settings.Secrets, secret)
+		}
 	}
-	settings.Secret = secret
+	if len(settings.Secrets) == 0 {
+		secret := os.Getenv("ATLAS_SECRET")
+		if secret == "" {
+			log.Fatal("env variables ATLAS_SECRETS and ATLAS_SECRET are not set")
+		}
+		settings.Secrets = []string{secret}
+	}
+	settings.UpstreamSelection = os.Getenv("UPSTREAM_SELECTION")
+	switch settings.UpstreamSelection {
+	case "":
+		settings.UpstreamSelection = selectLeastLoaded
+	case selectLeastLoaded, selectRoundRobin:
+	default:
+		log.Fatal(fmt.Errorf("env variable UPSTREAM_SELECTION should be %q or %q",
+			selectLeastLoaded, selectRoundRobin))
+	}
+	settings.UpstreamCooldown = envDuration("UPSTREAM_COOLDOWN", defaultUpstreamCooldown)
+	settings.ProbeBackoff = envDuration("UPSTREAM_PROBE_BACKOFF", defaultProbeBackoff)
+	settings.ProbeMaxBackoff = envDuration("UPSTREAM_PROBE_MAX_BACKOFF", defaultProbeMaxBackoff)
+	if settings.ProbeBackoff <= 0 || settings.ProbeMaxBackoff < settings.ProbeBackoff {
+		log.Fatal("env variables UPSTREAM_PROBE_BACKOFF and UPSTREAM_PROBE_MAX_BACKOFF should be positive and increasing")
+	}
+	settings.UpstreamStateStore = os.Getenv("US_STATE_STORE")
+	switch settings.UpstreamStateStore {
+	case "", stateStoreFile, stateStoreRedis:
+	default:
+		log.Fatal(fmt.Errorf("env variable US_STATE_STORE should be empty, %q or %q",
+			stateStoreFile, stateStoreRedis))
+	}
+	settings.UpstreamStatePath = os.Getenv("US_STATE_PATH")
+	if settings.UpstreamStatePath == "" {
+		settings.UpstreamStatePath = defaultUpstreamStatePath
+	}
+	settings.PlanPriorities = envMap("PLAN_PRIORITIES", strconv.Atoi)
+	settings.PlanWeights = envMap("PLAN_WEIGHTS", func(str string) (int, error) {
+		weight, err := strconv.Atoi(str)
+		if err == nil && weight < 1 {
+			err = fmt.Errorf("weight %d is not positive", weight)
+		}
+		return weight, err
+	})
+	settings.PlanMinShares = envMap("PLAN_MIN_SHARES", func(str string) (float64, error) {
+		share, err := strconv.ParseFloat(str, 64)
+		if err == nil && (share < 0 || share > 1) {
+			err = fmt.Errorf("share %v is not in the range [0 .. 1]", share)
+		}
+		return share, err
+	})
 
 	url := os.Getenv("ATLAS_URL")
 	if url == "" {
-		url = "https://atlas.abiosgaming.com/v3"
+		url = atlasURL
 	}
 	settings.URL = url
 
+	settings.MaxTake = envInt("MAX_TAKE", defaultMaxTake)
+	if settings.MaxTake < 1 {
+		log.Fatal("env variable MAX_TAKE should be positive")
+	}
+	settings.RouteCosts = envMap("ROUTE_COSTS", func(str string) (int, error) {
+		cost, err := strconv.Atoi(str)
+		if err == nil && cost < 1 {
+			err = fmt.Errorf("cost %d is not positive", cost)
+		}
+		return cost, err
+	})
+	settings.TakeCostStep = envInt("TAKE_COST_STEP", atlasPageSize)
+	if settings.TakeCostStep < 1 {
+		log.Fatal("env variable TAKE_COST_STEP should be positive")
+	}
+	settings.ETagMaxBodySize = int64(envInt("ETAG_MAX_BODY_SIZE", defaultETagMaxBodySize))
+	if settings.ETagMaxBodySize < 0 {
+		log.Fatal("env variable ETAG_MAX_BODY_SIZE should not be negative")
+	}
+
+	settings.AdminAddr = os.Getenv("ADMIN_ADDR")
+	settings.AdminToken = os.Getenv("ADMIN_TOKEN")
+	settings.RotationGrace = envDuration("ROTATION_GRACE", defaultRotationGrace)
+	if settings.RotationGrace < 0 {
+		log.Fatal("env variable ROTATION_GRACE should not be negative")
+	}
+
 	settings.dsRlmSettings = dsStreamRlmSettings()
+	if err := settings.validateCosts(); err != nil {
+		log.Fatal(fmt.Errorf("env variables ROUTE_COSTS and TAKE_COST_STEP: %v", err))
+	}
+	settings.usRlmSettings = usRlmSettings(settings.PlanMinShares)
+	settings.transport = transportSettings()
 	return settings
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/yambabmay/yyabws/server/rlmu"
+)
+
+// Upstream rate limiters state stores
+const (
+	stateStoreFile  = "file"
+	stateStoreRedis = "redis"
+)
+
+// stateKey - The key the state of the upstream rate limiter of an
+// Atlas secret is saved under. The secret itself is not written
+// to the store.
+func stateKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// stateStore - Creates the store of the upstream rate limiters
+// states, nil if the states are not saved.
+func (s *atlasClient) stateStore() (rlmu.Store, error) {
+	switch s.settings.UpstreamStateStore {
+	case stateStoreFile:
+		return rlmu.NewFileStore(s.settings.UpstreamStatePath)
+	case stateStoreRedis:
+		return rlmu.NewRedisStore(redis.NewClient(s.settings.dsRlmSettings.RedisOptions())), nil
+	}
+	return nil, nil
+}
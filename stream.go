@@ -0,0 +1,208 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Content encodings the proxy can relay to the downstream clients.
+// Only "gzip" can be produced on the fly or decoded by the proxy
+// itself, "br" is relayed as is.
+var relayEncodings = []string{"br", "gzip"}
+
+// streamBufferSize is the size of the chunks flushed to the client.
+const streamBufferSize = 32 * 1024
+
+// acceptedEncodings - parses an Accept-Encoding header into a map
+// of encodings to their quality value. Encodings with a quality
+// value of 0 are explicitly refused by the client.
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if params != "" {
+			key, val, ok := strings.Cut(strings.TrimSpace(params), "=")
+			if ok && strings.TrimSpace(key) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	return accepted
+}
+
+// accepts - returns true if the client accepts the encoding
+func accepts(accepted map[string]float64, encoding string) bool {
+	if q, ok := accepted[encoding]; ok {
+		return q > 0
+	}
+	if q, ok := accepted["*"]; ok {
+		return q > 0
+	}
+	return false
+}
+
+// upstreamAcceptEncoding - builds the Accept-Encoding header sent
+// to Atlas from the one of the downstream request. Only the encodings
+// the proxy knows how to relay are negotiated. An empty value means
+// the HTTP client negotiates and decodes gzip transparently.
+func upstreamAcceptEncoding(downstream string) string {
+	accepted := acceptedEncodings(downstream)
+	var encodings []string
+	for _, encoding := range relayEncodings {
+		if accepts(accepted, encoding) {
+			encodings = append(encodings, encoding)
+		}
+	}
+	return strings.Join(encodings, ", ")
+}
+
+// compressible - returns true if a body of the content type is
+// worth compressing on the fly.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" ||
+		strings.HasSuffix(mediaType, "+json")
+}
+
+// upstreamEncoding - the content encoding of an upstream response
+func upstreamEncoding(upstream *http.Response) string {
+	encoding := strings.ToLower(strings.TrimSpace(upstream.Header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+// compressOnTheFly - returns true if the proxy should gzip an
+// upstream response that is not encoded.
+func compressOnTheFly(accepted map[string]float64, upstream *http.Response) bool {
+	return upstreamEncoding(upstream) == "" &&
+		accepts(accepted, "gzip") &&
+		compressible(upstream.Header.Get("Content-Type"))
+}
+
+// flushWriter - writes to the client and flushes after every write
+// so that the body is streamed instead of buffered. When zw is set
+// the body is gzip compressed on the fly.
+type flushWriter struct {
+	zw *gzip.Writer
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func newFlushWriter(resp http.ResponseWriter, compress bool) *flushWriter {
+	fw := &flushWriter{w: resp, rc: http.NewResponseController(resp)}
+	if compress {
+		fw.zw = gzip.NewWriter(resp)
+		fw.w = fw.zw
+	}
+	return fw
+}
+
+func (s *flushWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if s.zw != nil {
+		if err := s.zw.Flush(); err != nil {
+			return n, err
+		}
+	}
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
+
+// Close - terminates the compressed stream, if any.
+func (s *flushWriter) Close() error {
+	if s.zw != nil {
+		return s.zw.Close()
+	}
+	return nil
+}
+
+// streamResponse - writes the upstream response to the client.
+// The body is streamed with flushing and its encoding is relayed,
+// produced or decoded according to the Accept-Encoding header of the
+// downstream request. The Content-Length header is only set when it
+// is known to be valid for the bytes sent to the client.
+func (s *atlasClient) streamResponse(resp http.ResponseWriter, req *http.Request, upstream *http.Response) {
+	accepted := acceptedEncodings(req.Header.Get("Accept-Encoding"))
+	encoding := upstreamEncoding(upstream)
+	contentType := upstream.Header.Get("Content-Type")
+
+	header := resp.Header()
+	header.Set("Content-Type", contentType)
+	header.Add("Vary", "Accept-Encoding")
+
+	body := io.Reader(upstream.Body)
+	var compress bool
+	switch {
+	case encoding == "":
+		if compressOnTheFly(accepted, upstream) {
+			// Negotiate gzip with the client
+			compress = true
+			header.Set("Content-Encoding", "gzip")
+		} else if upstream.ContentLength >= 0 {
+			header.Set("Content-Length", fmt.Sprintf("%d", upstream.ContentLength))
+		}
+	case accepts(accepted, encoding):
+		// Preserve the upstream encoding
+		header.Set("Content-Encoding", encoding)
+		if upstream.ContentLength >= 0 {
+			header.Set("Content-Length", fmt.Sprintf("%d", upstream.ContentLength))
+		}
+	case encoding == "gzip":
+		// The client does not accept gzip, decode it
+		zr, err := gzip.NewReader(upstream.Body)
+		if err != nil {
+			s.logger.Error("decoding gzip response from atlas", zap.Error(err))
+			resp.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		s.logger.Error("unsupported content encoding from atlas", zap.String("encoding", encoding))
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+
+	out := newFlushWriter(resp, compress)
+	defer out.Close()
+	buf := make([]byte, streamBufferSize)
+	if _, err := io.CopyBuffer(out, body, buf); err != nil {
+		s.logger.Debug("streaming response", zap.Error(err))
+		return
+	}
+	if hb, ok := upstream.Body.(*hashingBody); ok {
+		if etag := hb.etag(); etag != "" {
+			// Sent in the trailer declared by validators
+			header.Set("ETag", etag)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newHTTPClient - Creates the HTTP client shared by all the requests
+// sent to Atlas. The connections are pooled and every stage of a
+// request up to the response headers is bounded by a timeout, so a
+// hung Atlas connection can not pin a request handler forever. The
+// reads of the body are bounded by fetch, see readDeadlineBody.
+func newHTTPClient(settings *TransportSettings) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   settings.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   settings.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: settings.ResponseHeaderTimeout,
+		IdleConnTimeout:       settings.IdleConnTimeout,
+		MaxIdleConns:          settings.MaxIdleConns,
+		MaxIdleConnsPerHost:   settings.MaxIdleConns,
+		MaxConnsPerHost:       settings.MaxConnsPerHost,
+	}
+	return &http.Client{Transport: transport}
+}
+
+// readDeadlineBody - A response body whose request is canceled when a
+// read waits for data longer than the timeout. The time the reader
+// spends between the reads, writing to a slow client, is not counted.
+type readDeadlineBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+}
+
+func newReadDeadlineBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *readDeadlineBody {
+	timer := time.AfterFunc(timeout, cancel)
+	timer.Stop()
+	return &readDeadlineBody{ReadCloser: body, timeout: timeout, timer: timer, cancel: cancel}
+}
+
+func (s *readDeadlineBody) Read(p []byte) (int, error) {
+	s.timer.Reset(s.timeout)
+	defer s.timer.Stop()
+	return s.ReadCloser.Read(p)
+}
+
+// Close - closes the body and releases the context of its request
+func (s *readDeadlineBody) Close() error {
+	s.timer.Stop()
+	err := s.ReadCloser.Close()
+	s.cancel()
+	return err
+}